@@ -1,27 +1,44 @@
 package main
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"filippo.io/age"
-	"filippo.io/age/armor"
+	"filippo.io/age/plugin"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
 )
 
-const (
-	recipientFilename       = ".strongbox_recipient"
-	defaultIdentityFilename = ".strongbox_identity"
-)
+const defaultIdentityFilename = ".strongbox_identity"
+
+var (
+	identityFilename string
+	// sshIdentityFilenames are SSH private keys used as identities if they
+	// exist, eg `~/.ssh/id_ed25519`
+	sshIdentityFilenames []string
 
-var identityFilename string
+	// useIdentityEnv is set if identities may be given by identityEnv or
+	// identityFDEnv instead of the identity file
+	useIdentityEnv bool
+	// identitySource describes where identities were loaded from
+	identitySource string
+
+	// identities are parsed once per process, see loadIdentities
+	identitiesOnce sync.Once
+	identities     []age.Identity
+	identitiesErr  error
+)
 
-func ageGenIdentity(desc string) {
+// ageGenIdentity generates an identity and adds it to the identity file. The
+// identity file is encrypted with a passphrase if protect is set, a file
+// which is already passphrase protected stays so.
+func ageGenIdentity(desc string, protect bool) {
 	identity, err := age.GenerateX25519Identity()
 	if err != nil {
 		log.Fatalf("Failed to generate identity: %v", err)
@@ -29,141 +46,180 @@ func ageGenIdentity(desc string) {
 
 	fmt.Printf("public key: %s\n", identity.Recipient().String())
 
-	f, err := os.OpenFile(identityFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
-	// we assume that file has a trailing newline
-	if _, err := f.Write([]byte(fmt.Sprintf("# description: %s\n# public key: %s\n%s\n", desc, identity.Recipient().String(), identity.String()))); err != nil {
-		log.Fatal(err)
-	}
-	if err := f.Close(); err != nil {
+	entry := identityEntry{Description: desc, PublicKey: identity.Recipient().String(), Identity: identity.String()}
+	if err := addIdentityEntries([]identityEntry{entry}, protect); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func ageFileToRecipient(filename string) ([]age.Recipient, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-	return age.ParseRecipients(file)
-}
-
-func ageEncrypt(w io.Writer, r []age.Recipient, in []byte, f string) {
-	// We have to do check the following because age's encryption is non
-	// deterministic
-	//
-	// if there's no difference between the decrypted version of the file
-	// at HEAD and the new contents AND file's recipient hasn't changed, do
-	// not re-encrypt
-	if agePlaintextEqual(in, f) && !ageRecipientChanged(f) {
-		fah := ageFileAtHEAD(f)
-		if _, err := io.Copy(w, bytes.NewReader(fah)); err != nil {
-			log.Fatal(err)
+// addIdentityEntries appends entries to the identity file, see ageGenIdentity
+// for protect
+func addIdentityEntries(entries []identityEntry, protect bool) error {
+	var passphrase []byte
+	if protect {
+		content, err := os.ReadFile(identityFilename)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if !strongbox.IsPassphraseProtected(content) {
+			if passphrase, err = newPassphrase(fmt.Sprintf("Enter new passphrase for %s: ", identityFilename)); err != nil {
+				return err
+			}
 		}
-		return
 	}
+	return editIdentityFile(passphrase, func(content []byte) ([]byte, error) {
+		return appendIdentityEntries(content, entries), nil
+	})
+}
 
-	armorWriter := armor.NewWriter(w)
-	wc, err := age.Encrypt(armorWriter, r...)
+// editIdentityFile replaces the plaintext content of the identity file with
+// the result of edit. The identity file is locked while it's edited and never
+// left half written, filters reading it concurrently see either version. A
+// passphrase protected file stays so, otherwise it's encrypted with
+// passphrase if it's not nil. A missing identity file is created.
+func editIdentityFile(passphrase []byte, edit func(content []byte) ([]byte, error)) error {
+	unlock, err := lockFile(identityFilename + ".lock")
 	if err != nil {
-		log.Fatalf("Failed to create encrypted file: %v", err)
+		return fmt.Errorf("unable to lock %s: %w", identityFilename, err)
 	}
-	if _, err := io.Copy(wc, bytes.NewReader(in)); err != nil {
-		log.Fatal(err)
+	defer unlock()
+	content, filePassphrase, err := readIdentityFile()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
 	}
-	if err := wc.Close(); err != nil {
-		log.Fatalf("Failed to close encrypted file: %v", err)
+	if filePassphrase != nil {
+		passphrase = filePassphrase
 	}
-	if err := armorWriter.Close(); err != nil {
-		log.Fatalf("Failed to close armor: %v", err)
+	if content, err = edit(content); err != nil {
+		return err
 	}
+	return writeIdentityFile(content, passphrase)
 }
 
-func ageDecrypt(w io.Writer, in []byte) {
-	identityFile, err := os.Open(identityFilename)
-	if err != nil {
-		// identity file doesn't exist, copy as is and return
-		if _, err = io.Copy(w, bytes.NewReader(in)); err != nil {
-			log.Println(err)
+// writeIdentityFile replaces the identity file with content, encrypted with
+// passphrase unless it's nil. The file is written with mode 0600 and never
+// left half written.
+func writeIdentityFile(content, passphrase []byte) error {
+	if passphrase != nil {
+		var err error
+		if content, err = strongbox.EncryptIdentityFile(content, passphrase); err != nil {
+			return err
 		}
-		return
 	}
-	defer identityFile.Close()
-	identities, err := age.ParseIdentities(identityFile)
+	tmp, err := os.CreateTemp(filepath.Dir(identityFilename), ".strongbox_identity-*")
 	if err != nil {
-		// could not parse identity file, copy as is and return
-		if _, err = io.Copy(w, bytes.NewReader(in)); err != nil {
-			log.Println(err)
-		}
-		return
+		return err
 	}
-	armorReader := armor.NewReader(bytes.NewReader(in))
-	ar, err := age.Decrypt(armorReader, identities...)
-	if err != nil {
-		// couldn't find the key, copy as is and return
-		if _, err = io.Copy(w, bytes.NewReader(in)); err != nil {
-			log.Println(err)
-		}
-		return
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
 	}
-	if _, err := io.Copy(w, ar); err != nil {
-		log.Fatal(err)
+	if err := tmp.Close(); err != nil {
+		return err
 	}
+	return os.Rename(tmp.Name(), identityFilename)
 }
 
-func agePlaintextEqual(in []byte, f string) bool {
-	command := []string{"cat-file", "-e", fmt.Sprintf("HEAD:%s", f)}
-	cmd := exec.Command("git", command...)
-	// if git cat-file -e fails, then the file doesn't exist at HEAD, so it's new,
-	// meaning we need to encrypt it for the first time
-	if _, err := cmd.CombinedOutput(); err != nil {
-		return false
-	}
-
-	fileAtHEAD := ageFileAtHEAD(f)
-	// potentially re-encrypting SIV file
-	if !strings.HasPrefix(string(fileAtHEAD), armor.Header) {
-		return false
-	}
-	var plaintext bytes.Buffer
-	ageDecrypt(&plaintext, fileAtHEAD)
-	return bytes.Equal(plaintext.Bytes(), in)
+// loadIdentities parses the identity file and the SSH keys of
+// sshIdentityFilenames on first call and returns the same identities
+// afterwards. A missing identity file isn't an error if there are SSH keys.
+// If an agent is used, it's the only identity. Identities given by the
+// environment replace the identity file.
+func loadIdentities() ([]age.Identity, error) {
+	identitiesOnce.Do(func() {
+		if agentSocket != "" {
+			identities, identitySource = []age.Identity{agentIdentity{socket: agentSocket}}, "strongbox agent "+agentSocket
+			return
+		}
+		if useIdentityEnv {
+			content, source, ok, err := identityFromEnv()
+			if ok {
+				identitySource = source
+				if identities, identitiesErr = nil, err; err == nil {
+					identities, identitiesErr = parseIdentityFile(source, content)
+				}
+				return
+			}
+		}
+		identitySource = "identity file " + identityFilename
+		identities, identitiesErr = loadIdentityFile(identityFilename)
+		var sshIdentities []age.Identity
+		for _, filename := range sshIdentityFilenames {
+			pemBytes, err := os.ReadFile(filename)
+			if err != nil {
+				continue
+			}
+			// keys which can't be used are skipped, they aren't
+			// strongbox specific
+			if identity, err := parseSSHIdentity(filename, pemBytes); err == nil {
+				sshIdentities = append(sshIdentities, identity)
+			}
+		}
+		if len(sshIdentities) > 0 {
+			identities = append(identities, sshIdentities...)
+			if errors.Is(identitiesErr, fs.ErrNotExist) {
+				identitiesErr = nil
+			}
+		}
+	})
+	return identities, identitiesErr
 }
 
-func ageFileAtHEAD(f string) []byte {
-	command := []string{"cat-file", "-p", fmt.Sprintf("HEAD:%s", f)}
-	cmd := exec.Command("git", command...)
-	fileAtHEAD, err := cmd.CombinedOutput()
+// loadIdentityFile parses an identity file holding either age identities,
+// including plugin identities, or a SSH private key. The file may be
+// passphrase protected.
+func loadIdentityFile(filename string) ([]age.Identity, error) {
+	content, err := os.ReadFile(filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return fileAtHEAD
+	return parseIdentityFile(filename, content)
 }
 
-func ageRecipientChanged(filename string) bool {
-	path := filepath.Dir(filename)
-	for {
-		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
-			ageRecipientFilename := filepath.Join(path, recipientFilename)
-			// If we found `.strongbox_recipient` - compare it with HEAD version
-			if keyFile, err := os.Stat(ageRecipientFilename); err == nil && !keyFile.IsDir() {
-				fah := ageFileAtHEAD(ageRecipientFilename)
-				fod, err := os.ReadFile(ageRecipientFilename)
-				if err != nil {
-					log.Fatalf("Failed to open private keys file: %v", err)
-				}
-				return !bytes.Equal(fah, fod)
-			}
+// parseIdentityFile parses the content of an identity file, name is used in
+// passphrase prompts and errors
+func parseIdentityFile(filename string, content []byte) ([]age.Identity, error) {
+	if strongbox.IsSSHPrivateKey(content) {
+		identity, err := parseSSHIdentity(filename, content)
+		if err != nil {
+			return nil, err
 		}
-		if path == "." {
-			break
+		return []age.Identity{identity}, nil
+	}
+	if strongbox.IsPassphraseProtected(content) {
+		// the passphrase is only prompted for when a file is decrypted
+		identity := strongbox.NewPassphraseProtectedIdentity(content, func() ([]byte, error) {
+			return readPassphrase(fmt.Sprintf("Enter passphrase for %s: ", filename))
+		}, pluginUI)
+		return []age.Identity{&lockedIdentity{Identity: identity}}, nil
+	}
+	return parseAgeIdentities(string(content))
+}
+
+// parseAgeIdentities parses age identities, plugin identities interact with
+// the user through pluginUI
+func parseAgeIdentities(s string) ([]age.Identity, error) {
+	parsed, err := strongbox.ParseIdentitiesWithUI(strings.NewReader(s), pluginUI)
+	if err != nil {
+		return nil, err
+	}
+	for i, identity := range parsed {
+		if _, ok := identity.(*plugin.Identity); ok {
+			parsed[i] = &lockedIdentity{Identity: identity}
 		}
-		path = filepath.Dir(path)
 	}
+	return parsed, nil
+}
 
-	return false
+// parseSSHIdentity parses a SSH private key, the passphrase of protected keys
+// is prompted for when decrypting a file encrypted for the key
+func parseSSHIdentity(filename string, pemBytes []byte) (age.Identity, error) {
+	identity, err := strongbox.ParseSSHIdentity(pemBytes, func() ([]byte, error) {
+		return readPassphrase(fmt.Sprintf("Enter passphrase for %s: ", filename))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse SSH key %s: %w", filename, err)
+	}
+	return &lockedIdentity{Identity: identity}, nil
 }
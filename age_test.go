@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadSSHIdentities(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err)
+	dir := t.TempDir()
+	sshKey := filepath.Join(dir, "id_ed25519")
+	require.NoError(t, os.WriteFile(sshKey, pem.EncodeToMemory(block), 0o600))
+
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	recipients, err := strongbox.ParseRecipients(bytes.NewReader(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	require.NoError(t, err)
+	encrypted := ageEncryptTest(t, "secret", recipients...)
+
+	prevIdentityFilename := identityFilename
+	t.Cleanup(func() {
+		identityFilename = prevIdentityFilename
+		sshIdentityFilenames = nil
+		identitiesOnce = sync.Once{}
+	})
+	decrypt := func() (string, error) {
+		identitiesOnce = sync.Once{}
+		identities, err := loadIdentities()
+		if err != nil {
+			return "", err
+		}
+		var out strings.Builder
+		err = strongbox.Decrypt(bytes.NewReader(encrypted), &out, identities, nil)
+		return out.String(), err
+	}
+
+	// default SSH key, without an identity file
+	identityFilename = filepath.Join(dir, "missing")
+	sshIdentityFilenames = []string{filepath.Join(dir, "id_rsa"), sshKey}
+	plaintext, err := decrypt()
+	require.NoError(t, err)
+	require.Equal(t, "secret", plaintext)
+
+	// SSH key as identity file
+	identityFilename = sshKey
+	sshIdentityFilenames = nil
+	plaintext, err = decrypt()
+	require.NoError(t, err)
+	require.Equal(t, "secret", plaintext)
+
+	// neither
+	identityFilename = filepath.Join(dir, "missing")
+	_, err = decrypt()
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"filippo.io/age"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+// agentSocketEnv holds the socket of the agent, the filters ask the agent to
+// unwrap file keys, for siv keys by key-id and to decrypt siv content instead
+// of reading the identity file and keyring
+const agentSocketEnv = "STRONGBOX_AGENT_SOCK"
+
+// agentSocket is the socket of the agent used by this process, empty if none
+var agentSocket string
+
+// agentRequest is a line sent to the agent, Op is either unwrap, key or
+// decrypt. The keyring is never sent as a whole, siv content whose key-id
+// isn't known is decrypted by the agent.
+type agentRequest struct {
+	Op      string        `json:"op"`
+	Stanzas []*age.Stanza `json:"stanzas,omitempty"`
+	KeyID   []byte        `json:"key_id,omitempty"`
+	Content []byte        `json:"content,omitempty"`
+}
+
+// agentResponse is the agent's reply to an agentRequest, NotFound is set
+// when no identity or key matches
+type agentResponse struct {
+	FileKey   []byte `json:"file_key,omitempty"`
+	Key       []byte `json:"key,omitempty"`
+	Plaintext []byte `json:"plaintext,omitempty"`
+	NotFound  bool   `json:"not_found,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// runAgent is `strongbox agent`, it unlocks the identities and keyring and
+// serves them on a Unix socket until it's interrupted or, with -timeout, idle
+func runAgent(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("agent", flag.ContinueOnError)
+	socket := flags.String("socket", "", "Path of the socket, defaults to $XDG_RUNTIME_DIR/strongbox/agent.sock")
+	timeout := flags.Duration("timeout", 0, "Exit after being idle for this long, eg 1h, 0 means never")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	identities, err := loadIdentities()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to load %s: %w", identitySource, err)
+	}
+	// prompt for passphrases now, the filters can't
+	for _, identity := range identities {
+		if u, ok := identity.(interface{ Unlock() error }); ok {
+			if err := u.Unlock(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := kr.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to load keyring: %w", err)
+	}
+	keys, _ := kr.Keys()
+	if len(identities) == 0 && len(keys) == 0 {
+		return errors.New("no identities or keys to serve")
+	}
+
+	if *socket == "" {
+		if *socket, err = defaultAgentSocket(); err != nil {
+			return err
+		}
+	}
+	l, err := listenAgent(*socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(*socket)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		l.Close()
+	}()
+
+	fmt.Fprintf(w, "%s=%s; export %s;\n", agentSocketEnv, *socket, agentSocketEnv)
+	fmt.Fprintf(w, "# strongbox agent serving %d identities and %d siv keys\n", len(identities), len(keys))
+	return serveAgent(l, identities, kr, *timeout)
+}
+
+// defaultAgentSocket returns a socket path in a directory only the user can
+// access
+func defaultAgentSocket() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir != "" {
+		dir = filepath.Join(dir, "strongbox")
+	} else {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("strongbox-%d", os.Getuid()))
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode().Perm()&0o077 != 0 {
+		return "", fmt.Errorf("%s is accessible by other users", dir)
+	}
+	return filepath.Join(dir, "agent.sock"), nil
+}
+
+// listenAgent listens on socket, a stale socket of an agent which exited is
+// replaced
+func listenAgent(socket string) (*net.UnixListener, error) {
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("an agent is already listening on %s", socket)
+	}
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(socket, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serveAgent answers requests on l until it's closed. Connections from other
+// users are refused. If timeout isn't 0 the listener is closed once no
+// request was made for that long.
+func serveAgent(l *net.UnixListener, identities []age.Identity, keyRing strongbox.KeyRing, timeout time.Duration) error {
+	var idle *time.Timer
+	if timeout > 0 {
+		idle = time.AfterFunc(timeout, func() { l.Close() })
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.AcceptUnix()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if uid, err := peerUID(conn); err != nil || uid != os.Getuid() {
+			log.Printf("agent: refusing connection from uid %d: %v", uid, err)
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			scanner.Buffer(nil, 1<<20)
+			enc := json.NewEncoder(conn)
+			for scanner.Scan() {
+				if idle != nil {
+					idle.Reset(timeout)
+				}
+				var req agentRequest
+				resp := agentResponse{}
+				if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+					resp.Error = err.Error()
+				} else {
+					resp = handleAgentRequest(req, identities, keyRing)
+				}
+				if err := enc.Encode(resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func handleAgentRequest(req agentRequest, identities []age.Identity, keyRing strongbox.KeyRing) agentResponse {
+	var resp agentResponse
+	var err error
+	switch req.Op {
+	case "unwrap":
+		err = age.ErrIncorrectIdentity
+		for _, identity := range identities {
+			resp.FileKey, err = identity.Unwrap(req.Stanzas)
+			if !errors.Is(err, age.ErrIncorrectIdentity) {
+				break
+			}
+		}
+		resp.NotFound = errors.Is(err, age.ErrIncorrectIdentity)
+	case "key":
+		resp.Key, err = keyRing.Key(req.KeyID)
+		resp.NotFound = errors.Is(err, strongbox.ErrKeyNotFound) || errors.Is(err, os.ErrNotExist)
+	case "decrypt":
+		// siv only, age content is decrypted by the client with unwrap
+		if !bytes.HasPrefix(req.Content, strongbox.Prefix) {
+			err = errors.New("not siv content")
+			break
+		}
+		var out bytes.Buffer
+		err = strongbox.Decrypt(bytes.NewReader(req.Content), &out, nil, keyRing)
+		resp.Plaintext = out.Bytes()
+		resp.NotFound = errors.Is(err, strongbox.ErrKeyNotFound) || errors.Is(err, os.ErrNotExist)
+	default:
+		err = fmt.Errorf("unknown op %q", req.Op)
+	}
+	if err != nil && !resp.NotFound {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// agentCall sends req to the agent listening on socket
+func agentCall(socket string, req agentRequest) (agentResponse, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return agentResponse{}, fmt.Errorf("strongbox agent: %w", err)
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return agentResponse{}, fmt.Errorf("strongbox agent: %w", err)
+	}
+	var resp agentResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return agentResponse{}, fmt.Errorf("strongbox agent: %w", err)
+	}
+	if resp.Error != "" {
+		return agentResponse{}, fmt.Errorf("strongbox agent: %s", resp.Error)
+	}
+	return resp, nil
+}
+
+// agentIdentity asks the agent to unwrap file keys, the identities never
+// leave the agent
+type agentIdentity struct {
+	socket string
+}
+
+func (i agentIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	resp, err := agentCall(i.socket, agentRequest{Op: "unwrap", Stanzas: stanzas})
+	if err != nil {
+		return nil, err
+	}
+	if resp.NotFound {
+		return nil, age.ErrIncorrectIdentity
+	}
+	return resp.FileKey, nil
+}
+
+// agentKeyRing gets siv keys from the agent, keys are still added to and
+// saved in the keyring file
+type agentKeyRing struct {
+	keyRing
+	socket string
+}
+
+func (kr *agentKeyRing) Key(keyID []byte) ([]byte, error) {
+	resp, err := agentCall(kr.socket, agentRequest{Op: "key", KeyID: keyID})
+	if err != nil {
+		return []byte{}, err
+	}
+	if resp.NotFound {
+		return []byte{}, strongbox.ErrKeyNotFound
+	}
+	return resp.Key, nil
+}
+
+// Keys isn't served by the agent, siv content is decrypted by DecryptSIV
+// instead
+func (kr *agentKeyRing) Keys() ([][]byte, error) {
+	return nil, errors.New("strongbox agent: keys are only given out by key-id")
+}
+
+// DecryptSIV asks the agent to decrypt siv content whose key-id isn't known,
+// see strongbox.SIVDecrypter
+func (kr *agentKeyRing) DecryptSIV(enc []byte) ([]byte, error) {
+	resp, err := agentCall(kr.socket, agentRequest{Op: "decrypt", Content: enc})
+	if err != nil {
+		return nil, err
+	}
+	if resp.NotFound {
+		return nil, strongbox.ErrKeyNotFound
+	}
+	return resp.Plaintext, nil
+}
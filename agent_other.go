@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID isn't supported on this platform, the agent refuses all connections
+func peerUID(conn *net.UnixConn) (int, error) {
+	return -1, errors.New("peer credentials aren't supported on this platform")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+func TestAgent(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	require.NoError(t, err)
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := listenAgent(socket)
+	require.NoError(t, err)
+	_, err = listenAgent(socket)
+	require.Error(t, err, "only one agent should listen on a socket")
+	served := make(chan error, 1)
+	go func() {
+		served <- serveAgent(l, []age.Identity{identity}, strongbox.StaticKeyRing{key}, time.Second)
+	}()
+
+	decrypt := func(enc []byte) (string, error) {
+		var out strings.Builder
+		err := strongbox.Decrypt(bytes.NewReader(enc), &out, []age.Identity{agentIdentity{socket: socket}}, nil)
+		return out.String(), err
+	}
+	plaintext, err := decrypt(ageEncryptTest(t, "secret", identity.Recipient()))
+	require.NoError(t, err)
+	require.Equal(t, "secret", plaintext)
+	_, err = decrypt(ageEncryptTest(t, "secret", other.Recipient()))
+	var noMatch *age.NoIdentityMatchError
+	require.ErrorAs(t, err, &noMatch)
+
+	agentKeys := &agentKeyRing{socket: socket}
+	keyID := sha256.Sum256(key)
+	got, err := agentKeys.Key(keyID[:])
+	require.NoError(t, err)
+	require.Equal(t, key, got)
+	_, err = agentKeys.Key([]byte("unknown"))
+	require.ErrorIs(t, err, strongbox.ErrKeyNotFound)
+	// the keyring isn't given out, siv content is decrypted by the agent
+	_, err = agentKeys.Keys()
+	require.Error(t, err)
+	var enc bytes.Buffer
+	require.NoError(t, strongbox.EncryptSIV(strings.NewReader("siv secret"), &enc, key))
+	var out strings.Builder
+	require.NoError(t, strongbox.Decrypt(bytes.NewReader(enc.Bytes()), &out, nil, agentKeys))
+	require.Equal(t, "siv secret", out.String())
+	otherKey := make([]byte, 32)
+	_, err = rand.Read(otherKey)
+	require.NoError(t, err)
+	enc.Reset()
+	require.NoError(t, strongbox.EncryptSIV(strings.NewReader("siv secret"), &enc, otherKey))
+	require.ErrorIs(t, strongbox.Decrypt(bytes.NewReader(enc.Bytes()), &out, nil, agentKeys), strongbox.ErrKeyNotFound)
+
+	// the agent exits once idle
+	select {
+	case err := <-served:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent didn't exit after the idle timeout")
+	}
+	_, err = agentKeys.Key(keyID[:])
+	require.Error(t, err)
+}
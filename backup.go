@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A backup of identities is meant to be printed and typed back in. The data of
+// the bech32 encoded identity, eg `AGE-SECRET-KEY-1<data>`, is split in lines
+// of 16 characters in groups of 4, each followed by a checksum of the line so
+// typos are found:
+//
+//	strongbox identity backup
+//	description: laptop
+//	public key: age1...
+//	type: AGE-SECRET-KEY-1
+//	 1: QPZR Y9X8 GF2T VDW0  S3
+//	 2: ...
+//	end
+const (
+	backupHeader = "strongbox identity backup"
+	backupEnd    = "end"
+	// backupLineLength is the number of characters of data per line
+	backupLineLength = 16
+	// bech32Charset is the alphabet of the data and the checksums
+	bech32Charset = "QPZRY9X8GF2TVDW0S3JN54KHCE6MUA7L"
+)
+
+// encodeBackup returns the backup of entries
+func encodeBackup(entries []identityEntry) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Keep this backup safe, anyone who has it can decrypt your files.\n")
+	fmt.Fprintf(&b, "# Restore it with `strongbox identity import`.\n")
+	for _, entry := range entries {
+		identity := strings.ToUpper(entry.Identity)
+		i := strings.LastIndex(identity, "1")
+		if !strings.HasPrefix(identity, "AGE-") || i < 0 {
+			return "", fmt.Errorf("%s can't be backed up, only age identities can", entry.name())
+		}
+		prefix, data := identity[:i+1], identity[i+1:]
+
+		fmt.Fprintf(&b, "\n%s\n", backupHeader)
+		if entry.Description != "" {
+			fmt.Fprintf(&b, "description: %s\n", entry.Description)
+		}
+		if entry.PublicKey != "" {
+			fmt.Fprintf(&b, "public key: %s\n", entry.PublicKey)
+		}
+		fmt.Fprintf(&b, "type: %s\n", prefix)
+		for n := 1; len(data) > 0; n++ {
+			chunk := data[:min(backupLineLength, len(data))]
+			data = data[len(chunk):]
+			var groups []string
+			for j := 0; j < len(chunk); j += 4 {
+				groups = append(groups, chunk[j:min(j+4, len(chunk))])
+			}
+			fmt.Fprintf(&b, "%2d: %-19s  %s\n", n, strings.Join(groups, " "), backupChecksum(n, chunk))
+		}
+		fmt.Fprintf(&b, "%s\n", backupEnd)
+	}
+	return b.String(), nil
+}
+
+// backupChecksum returns the checksum of line n of data, two characters of
+// bech32Charset. The line number is included so swapped lines are found.
+func backupChecksum(n int, chunk string) string {
+	sum := sha256.Sum256([]byte(strconv.Itoa(n) + ":" + chunk))
+	return string([]byte{bech32Charset[sum[0]&31], bech32Charset[sum[1]&31]})
+}
+
+// decodeBackup parses a backup written by encodeBackup, typed back in. Case and
+// spacing don't matter, a line whose checksum doesn't match is an error.
+func decodeBackup(r io.Reader) ([]identityEntry, error) {
+	var entries []identityEntry
+	var entry identityEntry
+	var prefix string
+	var data strings.Builder
+	inBackup := false
+	lineNumber := 0
+
+	scanner := bufio.NewScanner(r)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !inBackup {
+			if !strings.EqualFold(line, backupHeader) {
+				return nil, fmt.Errorf("line %d: expected %q", n, backupHeader)
+			}
+			inBackup, entry, prefix, lineNumber = true, identityEntry{}, "", 0
+			data.Reset()
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch key := strings.ToLower(strings.TrimSpace(key)); {
+		case key == "description":
+			entry.Description = value
+		case key == "public key":
+			entry.PublicKey = value
+		case key == "type":
+			prefix = strings.ToUpper(value)
+		case strings.EqualFold(line, backupEnd):
+			if err := entry.fromBackup(prefix, data.String()); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			entries = append(entries, entry)
+			inBackup = false
+		default:
+			number, err := strconv.Atoi(key)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: unexpected %q", n, line)
+			}
+			lineNumber++
+			if number != lineNumber {
+				return nil, fmt.Errorf("line %d: expected data line %d, got %d", n, lineNumber, number)
+			}
+			fields := strings.Fields(strings.ToUpper(value))
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: missing checksum", n)
+			}
+			chunk := strings.Join(fields[:len(fields)-1], "")
+			if backupChecksum(number, chunk) != fields[len(fields)-1] {
+				return nil, fmt.Errorf("line %d: checksum mismatch, check data line %d for typos", n, number)
+			}
+			data.WriteString(chunk)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if inBackup {
+		return nil, fmt.Errorf("backup is incomplete, missing %q", backupEnd)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no identities found in backup")
+	}
+	return entries, nil
+}
+
+// fromBackup sets the identity of e from the prefix and data of a backup, the
+// identity is checked against its public key if known
+func (e *identityEntry) fromBackup(prefix, data string) error {
+	if prefix == "" || data == "" {
+		return errors.New("identity missing from backup")
+	}
+	e.Identity = prefix + data
+	if _, err := parseIdentityLine(e.Identity); err != nil {
+		return fmt.Errorf("invalid identity: %w", err)
+	}
+	recipient := e.recipient()
+	if e.PublicKey != "" && recipient != e.PublicKey {
+		return fmt.Errorf("identity doesn't match public key %s", e.PublicKey)
+	}
+	e.PublicKey = recipient
+	return nil
+}
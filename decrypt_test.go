@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+func TestRecursiveDecryptMixed(t *testing.T) {
+	useTestIdentities(t)
+	dir := t.TempDir()
+
+	key, keyID := useTestKeyRing(t)
+	recipients := testRecipients(t)
+	unknown, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	sivEnc := sivEncryptTest(t, "siv-secret", key)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "siv"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "siv", strongbox.KeyIDFilename), []byte(keyID), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "siv", "secret"), sivEnc, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "age-secret"), ageEncryptTest(t, "age-secret", recipients...), 0o644))
+	unknownEnc := ageEncryptTest(t, "unknown-secret", unknown.Recipient())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "age-unknown"), unknownEnc, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "plain"), []byte("plain"), 0o644))
+
+	require.Error(t, recursiveDecrypt(dir, nil, nil), "file encrypted for unknown identity should be reported")
+
+	read := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		return string(b)
+	}
+	require.Equal(t, "siv-secret", read("siv/secret"))
+	require.Equal(t, "age-secret", read("age-secret"))
+	require.Equal(t, string(unknownEnc), read("age-unknown"))
+	require.Equal(t, "plain", read("plain"))
+
+	// identity given explicitly
+	dk, identities, err := parseKeyFlag(unknown.String())
+	require.NoError(t, err)
+	require.Nil(t, dk)
+	require.NoError(t, recursiveDecrypt(dir, dk, identities))
+	require.Equal(t, "unknown-secret", read("age-unknown"))
+}
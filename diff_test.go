@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTextconv(t *testing.T) {
+	useTestIdentities(t)
+	key, _ := useTestKeyRing(t)
+
+	plaintext := "t0ps3cret\n"
+
+	t.Run("siv", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, textconv(&out, sivEncryptTest(t, plaintext, key)))
+		require.Equal(t, plaintext, out.String())
+	})
+
+	t.Run("siv unknown key", func(t *testing.T) {
+		otherKey := make([]byte, 32)
+		_, err := rand.Read(otherKey)
+		require.NoError(t, err)
+		enc := sivEncryptTest(t, plaintext, otherKey)
+
+		var out bytes.Buffer
+		require.NoError(t, textconv(&out, enc))
+		require.Equal(t, string(enc), out.String(), "ciphertext should be copied as is")
+	})
+
+	t.Run("age", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, textconv(&out, ageEncryptTest(t, plaintext, testRecipients(t)...)))
+		require.Equal(t, plaintext, out.String())
+	})
+
+	t.Run("plaintext", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, textconv(&out, []byte(plaintext)))
+		require.Equal(t, plaintext, out.String())
+	})
+}
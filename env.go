@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+	"gopkg.in/yaml.v2"
+)
+
+// Identities and keys can be given through the environment, eg by CI systems,
+// instead of files
+const (
+	// identityEnv holds the content of an identity file
+	identityEnv = "STRONGBOX_IDENTITY"
+	// identityFDEnv holds the number of an inherited file descriptor to read
+	// the content of an identity file from
+	identityFDEnv = "STRONGBOX_IDENTITY_FD"
+	// keyRingEnv holds the content of a keyring file
+	keyRingEnv = "STRONGBOX_KEYRING"
+)
+
+// identityFromEnv returns the identity file content given by identityEnv or
+// identityFDEnv and the name of the variable, ok is false if neither is set
+func identityFromEnv() (content []byte, source string, ok bool, err error) {
+	if v, ok := os.LookupEnv(identityEnv); ok {
+		return []byte(v), "$" + identityEnv, true, nil
+	}
+	v, ok := os.LookupEnv(identityFDEnv)
+	if !ok {
+		return nil, "", false, nil
+	}
+	source = "$" + identityFDEnv
+	fd, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || fd < 0 {
+		return nil, source, true, fmt.Errorf("invalid %s value %q", source, v)
+	}
+	content, err = readFD(fd)
+	if err != nil {
+		return nil, source, true, fmt.Errorf("unable to read %s %d: %w", source, fd, err)
+	}
+	return content, source, true, nil
+}
+
+// readFD reads all of a file descriptor. Regular files are read from the
+// start without moving the offset, which is shared with the other processes
+// which inherited the descriptor, eg the filters git runs.
+func readFD(fd int) ([]byte, error) {
+	f := os.NewFile(uintptr(fd), "fd "+strconv.Itoa(fd))
+	if f == nil {
+		return nil, errors.New("invalid file descriptor")
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().IsRegular() {
+		return io.ReadAll(io.NewSectionReader(f, 0, fi.Size()))
+	}
+	return io.ReadAll(f)
+}
+
+// envKeyRing is a keyring read from keyRingEnv, it can't be saved
+type envKeyRing struct {
+	*strongbox.FileKeyRing
+	content string
+}
+
+func newEnvKeyRing(content string) *envKeyRing {
+	return &envKeyRing{FileKeyRing: strongbox.NewFileKeyRing(""), content: content}
+}
+
+func (kr *envKeyRing) Load() error {
+	return yaml.Unmarshal([]byte(kr.content), kr.FileKeyRing)
+}
+
+func (kr *envKeyRing) Save() error {
+	return fmt.Errorf("the keyring is read from $%s, it can't be saved", keyRingEnv)
+}
+
+// keyFromFlags returns the key given by either -key, -key-file or -key-stdin
+func keyFromFlags(key, keyFile string, keyStdin bool, stdin io.Reader) (string, error) {
+	var n int
+	for _, set := range []bool{key != "", keyFile != "", keyStdin} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return "", errors.New("only one of -key, -key-file and -key-stdin can be used")
+	}
+	switch {
+	case keyFile != "":
+		content, err := os.ReadFile(keyFile)
+		return string(content), err
+	case keyStdin:
+		content, err := io.ReadAll(stdin)
+		return string(content), err
+	}
+	return key, nil
+}
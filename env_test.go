@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+	"gopkg.in/yaml.v2"
+)
+
+func TestIdentityFromEnv(t *testing.T) {
+	identityFile, err := os.ReadFile(filepath.Join("testdata", defaultIdentityFilename))
+	require.NoError(t, err)
+	encrypted := ageEncryptTest(t, "secret", testRecipients(t)...)
+
+	prevIdentityFilename := identityFilename
+	t.Cleanup(func() {
+		identityFilename = prevIdentityFilename
+		useIdentityEnv = false
+		identitiesOnce = sync.Once{}
+	})
+	identityFilename = filepath.Join(t.TempDir(), "missing")
+	useIdentityEnv = true
+	decrypt := func() (string, error) {
+		identitiesOnce = sync.Once{}
+		identities, err := loadIdentities()
+		if err != nil {
+			return "", err
+		}
+		var out strings.Builder
+		err = strongbox.Decrypt(bytes.NewReader(encrypted), &out, identities, nil)
+		return out.String(), err
+	}
+	// dupFD returns a descriptor loadIdentities can close
+	dupFD := func(f *os.File) string {
+		fd, err := syscall.Dup(int(f.Fd()))
+		require.NoError(t, err)
+		return strconv.Itoa(fd)
+	}
+
+	t.Run("content", func(t *testing.T) {
+		t.Setenv(identityEnv, string(identityFile))
+		plaintext, err := decrypt()
+		require.NoError(t, err)
+		require.Equal(t, "secret", plaintext)
+		require.Equal(t, "$"+identityEnv, identitySource)
+	})
+
+	t.Run("pipe", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		defer r.Close()
+		_, err = w.Write(identityFile)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		t.Setenv(identityFDEnv, dupFD(r))
+		plaintext, err := decrypt()
+		require.NoError(t, err)
+		require.Equal(t, "secret", plaintext)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		f, err := os.Open(filepath.Join("testdata", defaultIdentityFilename))
+		require.NoError(t, err)
+		defer f.Close()
+		// the filters git runs share the descriptor, each should read all
+		// of the file
+		for range 2 {
+			t.Setenv(identityFDEnv, dupFD(f))
+			plaintext, err := decrypt()
+			require.NoError(t, err)
+			require.Equal(t, "secret", plaintext)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Setenv(identityFDEnv, "nope")
+		_, err := decrypt()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), identityFDEnv)
+	})
+
+	t.Run("identity file", func(t *testing.T) {
+		_, err := decrypt()
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestEnvKeyRing(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	keyID := sha256.Sum256(key)
+	fileKeyRing := strongbox.NewFileKeyRing("")
+	fileKeyRing.AddKey("ci", keyID[:], key)
+	content, err := yaml.Marshal(fileKeyRing)
+	require.NoError(t, err)
+
+	keyRing := &cachedKeyRing{keyRing: newEnvKeyRing(string(content))}
+	got, err := keyRing.Key(keyID[:])
+	require.NoError(t, err)
+	require.Equal(t, key, got)
+	require.Error(t, keyRing.Save())
+}
+
+func TestKeyFromFlags(t *testing.T) {
+	identityFile := filepath.Join("testdata", defaultIdentityFilename)
+	content, err := os.ReadFile(identityFile)
+	require.NoError(t, err)
+
+	k, err := keyFromFlags("", identityFile, false, nil)
+	require.NoError(t, err)
+	require.Equal(t, string(content), k)
+	k, err = keyFromFlags("", "", true, bytes.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, string(content), k)
+	_, err = keyFromFlags("key", "", true, nil)
+	require.Error(t, err)
+
+	// the whole identity file, with comments, can be given
+	dk, identities, err := parseKeyFlag(k)
+	require.NoError(t, err)
+	require.Nil(t, dk)
+	require.Len(t, identities, 1)
+}
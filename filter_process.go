@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// filterSession holds the state of a single long running filter process, see
+// https://git-scm.com/docs/gitattributes#_long_running_filter_process
+type filterSession struct {
+	in  *pktLineReader
+	out *pktLineWriter
+
+	// delay is true if git negotiated the delay capability
+	delay bool
+	// number of delayed blobs which are still being processed
+	pending int
+	// delayed blobs which are processed but not yet collected by git
+	available map[string]filterResult
+	ready     chan filterResult
+	workers   chan struct{}
+}
+
+type filterResult struct {
+	pathname string
+	content  []byte
+	err      error
+}
+
+type filterRequest struct {
+	command  string
+	pathname string
+	canDelay bool
+	// tree being checked out, only sent by git on checkout
+	treeish string
+}
+
+// filterProcess serves clean and smudge requests from git until git closes
+// the connection, so that identities and keyrings are only loaded once per
+// git command rather than once per file
+func filterProcess(r io.Reader, w io.Writer) error {
+	s := &filterSession{
+		in:        newPktLineReader(r),
+		out:       newPktLineWriter(w),
+		available: make(map[string]filterResult),
+		ready:     make(chan filterResult),
+		workers:   make(chan struct{}, runtime.GOMAXPROCS(0)),
+	}
+
+	if err := s.handshake(); err != nil {
+		return err
+	}
+
+	for {
+		header, err := s.in.readText()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		req, err := parseFilterRequest(header)
+		if err != nil {
+			return err
+		}
+
+		switch req.command {
+		case "clean", "smudge":
+			content, err := s.in.readContent()
+			if err != nil {
+				return err
+			}
+			if err := s.filter(req, content); err != nil {
+				return err
+			}
+		case "list_available_blobs":
+			if err := s.listAvailableBlobs(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown filter command %q", req.command)
+		}
+	}
+}
+
+func (s *filterSession) handshake() error {
+	welcome, err := s.in.readText()
+	if err != nil {
+		return err
+	}
+	if len(welcome) == 0 || welcome[0] != "git-filter-client" || !slices.Contains(welcome[1:], "version=2") {
+		return fmt.Errorf("unsupported filter protocol handshake %q", welcome)
+	}
+	if err := s.out.writeText("git-filter-server", "version=2"); err != nil {
+		return err
+	}
+	if err := s.out.Flush(); err != nil {
+		return err
+	}
+
+	capabilities, err := s.in.readText()
+	if err != nil {
+		return err
+	}
+	var supported []string
+	for _, c := range capabilities {
+		switch c {
+		case "capability=clean", "capability=smudge":
+			supported = append(supported, c)
+		case "capability=delay":
+			supported = append(supported, c)
+			s.delay = true
+		}
+	}
+	if err := s.out.writeText(supported...); err != nil {
+		return err
+	}
+	return s.out.Flush()
+}
+
+func parseFilterRequest(header []string) (filterRequest, error) {
+	var req filterRequest
+	for _, l := range header {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok {
+			return req, fmt.Errorf("invalid filter request line %q", l)
+		}
+		switch k {
+		case "command":
+			req.command = v
+		case "pathname":
+			req.pathname = v
+		case "can-delay":
+			req.canDelay = v == "1"
+		case "treeish":
+			req.treeish = v
+		}
+	}
+	if req.command == "" {
+		return req, fmt.Errorf("filter request without command %q", header)
+	}
+	return req, nil
+}
+
+func (s *filterSession) filter(req filterRequest, content []byte) error {
+	if req.command == "smudge" {
+		// git is collecting a blob we delayed earlier
+		if res, ok := s.available[req.pathname]; ok {
+			delete(s.available, req.pathname)
+			return s.respond(res)
+		}
+		if s.delay && req.canDelay {
+			s.delaySmudge(req, content)
+			if err := s.out.writeText("status=delayed"); err != nil {
+				return err
+			}
+			return s.out.Flush()
+		}
+	}
+	return s.respond(filterBlob(req, content))
+}
+
+// delaySmudge decrypts the blob in the background, git will ask for it once
+// it's listed by listAvailableBlobs
+func (s *filterSession) delaySmudge(req filterRequest, content []byte) {
+	s.pending++
+	go func() {
+		s.workers <- struct{}{}
+		res := filterBlob(req, content)
+		<-s.workers
+		s.ready <- res
+	}()
+}
+
+func (s *filterSession) listAvailableBlobs() error {
+	// block until at least one delayed blob is ready, an empty list tells git
+	// that there is nothing left to wait for
+	if len(s.available) == 0 && s.pending > 0 {
+		res := <-s.ready
+		s.pending--
+		s.available[res.pathname] = res
+	}
+	for drained := false; !drained; {
+		select {
+		case res := <-s.ready:
+			s.pending--
+			s.available[res.pathname] = res
+		default:
+			drained = true
+		}
+	}
+
+	var pathnames []string
+	for p := range s.available {
+		pathnames = append(pathnames, "pathname="+p)
+	}
+	slices.Sort(pathnames)
+	if err := s.out.writeText(pathnames...); err != nil {
+		return err
+	}
+	if err := s.out.writeText("status=success"); err != nil {
+		return err
+	}
+	return s.out.Flush()
+}
+
+func (s *filterSession) respond(res filterResult) error {
+	if res.err != nil {
+		log.Printf("unable to filter file:%s err:%s", res.pathname, res.err)
+		if err := s.out.writeText("status=error"); err != nil {
+			return err
+		}
+		return s.out.Flush()
+	}
+	if err := s.out.writeText("status=success"); err != nil {
+		return err
+	}
+	if err := s.out.writeContent(res.content); err != nil {
+		return err
+	}
+	// an empty list keeps the status unchanged
+	if err := s.out.writeFlush(); err != nil {
+		return err
+	}
+	return s.out.Flush()
+}
+
+func filterBlob(req filterRequest, content []byte) filterResult {
+	var buf bytes.Buffer
+	var err error
+	switch req.command {
+	case "clean":
+		err = clean(bytes.NewReader(content), &buf, req.pathname)
+	case "smudge":
+		err = smudge(bytes.NewReader(content), &buf, req.pathname, req.treeish)
+	}
+	return filterResult{pathname: req.pathname, content: buf.Bytes(), err: err}
+}
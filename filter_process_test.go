@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age/armor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterProcess(t *testing.T) {
+	useTestIdentities(t)
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- filterProcess(stdinR, stdoutW)
+		stdoutW.Close()
+	}()
+
+	git := newPktLineWriter(stdinW)
+	filter := newPktLineReader(stdoutR)
+
+	send := func(header []string, content string) {
+		t.Helper()
+		require.NoError(t, git.writeText(header...))
+		if header[0] != "command=list_available_blobs" {
+			require.NoError(t, git.writeContent([]byte(content)))
+		}
+		require.NoError(t, git.Flush())
+	}
+	readText := func() []string {
+		t.Helper()
+		lines, err := filter.readText()
+		require.NoError(t, err)
+		return lines
+	}
+	readResponse := func() string {
+		t.Helper()
+		require.Equal(t, []string{"status=success"}, readText())
+		content, err := filter.readContent()
+		require.NoError(t, err)
+		require.Empty(t, readText())
+		return string(content)
+	}
+
+	require.NoError(t, git.writeText("git-filter-client", "version=2"))
+	require.NoError(t, git.Flush())
+	require.Equal(t, []string{"git-filter-server", "version=2"}, readText())
+	require.NoError(t, git.writeText("capability=clean", "capability=smudge", "capability=delay", "capability=unknown"))
+	require.NoError(t, git.Flush())
+	require.Equal(t, []string{"capability=clean", "capability=smudge", "capability=delay"}, readText())
+
+	secretPath := filepath.Join("testdata", "secret-"+t.Name()+".txt")
+	plaintext := strings.Repeat("t0ps3cret\n", 10000)
+
+	send([]string{"command=clean", "pathname=" + secretPath}, plaintext)
+	encrypted := readResponse()
+	require.True(t, strings.HasPrefix(encrypted, armor.Header), "cleaned file should be encrypted")
+
+	send([]string{"command=smudge", "pathname=" + secretPath}, encrypted)
+	require.Equal(t, plaintext, readResponse(), "smudged file should be decrypted")
+
+	// delayed smudge
+	send([]string{"command=smudge", "pathname=" + secretPath, "can-delay=1"}, encrypted)
+	require.Equal(t, []string{"status=delayed"}, readText())
+
+	send([]string{"command=list_available_blobs"}, "")
+	require.Equal(t, []string{"pathname=" + secretPath}, readText())
+	require.Equal(t, []string{"status=success"}, readText())
+
+	send([]string{"command=smudge", "pathname=" + secretPath}, "")
+	require.Equal(t, plaintext, readResponse(), "delayed file should be decrypted")
+
+	send([]string{"command=list_available_blobs"}, "")
+	require.Empty(t, readText())
+	require.Equal(t, []string{"status=success"}, readText())
+
+	require.NoError(t, stdinW.Close())
+	require.NoError(t, <-done)
+}
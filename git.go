@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+// catFile is shared by everything that needs to read objects from the
+// repository, it starts `git cat-file --batch` on first use
+var catFile = &gitCatFile{}
+
+// gitCatFile reads objects through a single long running `git cat-file
+// --batch` process instead of spawning a new git process per lookup
+type gitCatFile struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	// err is set once the process failed, eg outside of a git repository, so
+	// it's not restarted for every lookup
+	err error
+	// index are the files of the index matching a pathspec, see
+	// indexEntries
+	index map[string][]indexEntry
+}
+
+// indexEntry is a file of the index, skipWorktree is set if it's excluded
+// from the working tree, eg by a sparse checkout
+type indexEntry struct {
+	path         string
+	skipWorktree bool
+}
+
+func (c *gitCatFile) start() error {
+	cmd := exec.Command("git", "cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start git cat-file: %w", err)
+	}
+	c.cmd = cmd
+	c.stdin = stdin
+	c.stdout = bufio.NewReader(stdout)
+	return nil
+}
+
+// Object returns the content of the object named by rev (eg `HEAD:path`),
+// ok is false if the object doesn't exist
+func (c *gitCatFile) Object(rev string) (content []byte, ok bool, err error) {
+	_, _, content, ok, err = c.object(rev)
+	return content, ok, err
+}
+
+// Tree returns the sorted names of the files, not sub trees, of the tree named
+// by rev (eg `HEAD:dir`), ok is false if it doesn't exist or isn't a tree
+func (c *gitCatFile) Tree(rev string) (names []string, ok bool, err error) {
+	oid, objectType, content, ok, err := c.object(rev)
+	if err != nil || !ok || objectType != "tree" {
+		return nil, false, err
+	}
+	// entries are `<mode> <name>\x00<binary oid>`, the oid of the tree has
+	// the same size
+	oidSize := len(oid) / 2
+	for len(content) > 0 {
+		mode, rest, ok := bytes.Cut(content, []byte(" "))
+		if !ok {
+			return nil, false, fmt.Errorf("malformed tree %s", oid)
+		}
+		name, rest, ok := bytes.Cut(rest, []byte{0})
+		if !ok || len(rest) < oidSize {
+			return nil, false, fmt.Errorf("malformed tree %s", oid)
+		}
+		content = rest[oidSize:]
+		if string(mode) != "40000" {
+			names = append(names, string(name))
+		}
+	}
+	return names, true, nil
+}
+
+// object returns the oid, type and content of the object named by rev
+func (c *gitCatFile) object(rev string) (oid, objectType string, content []byte, ok bool, err error) {
+	if strings.ContainsAny(rev, "\n") {
+		return "", "", nil, false, fmt.Errorf("invalid object name %q", rev)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return "", "", nil, false, c.err
+	}
+	if c.cmd == nil {
+		if c.err = c.start(); c.err != nil {
+			return "", "", nil, false, c.err
+		}
+	}
+
+	if _, err := io.WriteString(c.stdin, rev+"\n"); err != nil {
+		c.err = fmt.Errorf("git cat-file failed: %w", err)
+		return "", "", nil, false, c.err
+	}
+
+	// header is either `<oid> <type> <size>` or `<rev> missing`
+	header, err := c.stdout.ReadString('\n')
+	if err != nil {
+		c.err = fmt.Errorf("git cat-file failed: %w", err)
+		return "", "", nil, false, c.err
+	}
+	if strings.HasSuffix(header, " missing\n") || strings.HasSuffix(header, " ambiguous\n") {
+		return "", "", nil, false, nil
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return "", "", nil, false, fmt.Errorf("unexpected git cat-file output %q", header)
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return "", "", nil, false, fmt.Errorf("unexpected git cat-file output %q", header)
+	}
+
+	// content is followed by a LF
+	content = make([]byte, size+1)
+	if _, err := io.ReadFull(c.stdout, content); err != nil {
+		return "", "", nil, false, err
+	}
+	return fields[0], fields[1], content[:size], true, nil
+}
+
+// indexEntries returns the files of the index matching the glob pathspec.
+// Like cat-file the index is read once, c.mu must be held.
+func (c *gitCatFile) indexEntries(pattern string) ([]indexEntry, error) {
+	if entries, ok := c.index[pattern]; ok {
+		return entries, nil
+	}
+	// -v tags skip-worktree files with S, s if also assumed unchanged
+	out, err := exec.Command("git", "ls-files", "-v", "-z", "--", ":(glob)"+pattern).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files failed: %w", err)
+	}
+	var entries []indexEntry
+	for _, line := range strings.Split(string(out), "\x00") {
+		if tag, file, ok := strings.Cut(line, " "); ok {
+			entries = append(entries, indexEntry{path: file, skipWorktree: strings.EqualFold(tag, "S")})
+		}
+	}
+	if c.index == nil {
+		c.index = make(map[string][]indexEntry)
+	}
+	c.index[pattern] = entries
+	return entries, nil
+}
+
+// IndexDir returns the sorted names of the files of the directory name in the
+// index, ok is false if it has none. If skipWorktree is set only the files
+// excluded from the working tree are returned. The files of every directory
+// with the same base name are listed on first use.
+func (c *gitCatFile) IndexDir(name string, skipWorktree bool) (names []string, ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name = filepath.ToSlash(name)
+	entries, err := c.indexEntries("**/" + path.Base(name) + "/*")
+	if err != nil {
+		return nil, false, err
+	}
+	for _, e := range entries {
+		if dir, file := path.Split(e.path); dir == name+"/" && (e.skipWorktree || !skipWorktree) {
+			names = append(names, file)
+		}
+	}
+	return names, len(names) > 0, nil
+}
+
+// SkipWorktree returns true if name is in the index and excluded from the
+// working tree, eg by a sparse checkout. The files with the same base name are
+// listed on first use.
+func (c *gitCatFile) SkipWorktree(name string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name = filepath.ToSlash(name)
+	entries, err := c.indexEntries("**/" + path.Base(name))
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.path == name {
+			return e.skipWorktree, nil
+		}
+	}
+	return false, nil
+}
+
+// Close stops the git process if it was started, the index is read again on
+// next use
+func (c *gitCatFile) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.index = nil
+	if c.cmd == nil {
+		return nil
+	}
+	c.stdin.Close()
+	err := c.cmd.Wait()
+	c.cmd = nil
+	return err
+}
+
+// readRepoFile returns the content of a file in the working tree. Files
+// missing on disk are read from the tree being checked out (if known), the
+// index and HEAD, so that key files are found before they are checked out
+// (eg on clone) or when they are excluded by a sparse checkout. If worktree
+// is set files missing on disk were deleted, only those excluded by a sparse
+// checkout are read from the index.
+func readRepoFile(name, treeish string, worktree bool) ([]byte, bool, error) {
+	if fi, err := os.Stat(name); err == nil {
+		if fi.IsDir() {
+			return nil, false, nil
+		}
+		content, err := os.ReadFile(name)
+		return content, err == nil, err
+	}
+
+	// only paths relative to the root of the repository can be looked up
+	if !filepath.IsLocal(name) {
+		return nil, false, nil
+	}
+	name = filepath.ToSlash(name)
+
+	revs := []string{":" + name}
+	if worktree {
+		if skip, err := catFile.SkipWorktree(name); err != nil || !skip {
+			return nil, false, nil
+		}
+	} else if treeish != "" {
+		revs = append([]string{treeish + ":" + name}, revs...)
+	} else {
+		revs = append(revs, "HEAD:"+name)
+	}
+	for _, rev := range revs {
+		content, ok, err := catFile.Object(rev)
+		if err != nil {
+			// git is only a fallback for files missing on disk, if it
+			// isn't usable (not a repository) the file is just not found
+			return nil, false, nil
+		}
+		if ok {
+			return content, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// readRepoDir returns the names of the files of a directory in the working
+// tree. Like readRepoFile, directories missing on disk are read from the tree
+// being checked out (if known), the index and HEAD, or if worktree is set
+// from the files of the index excluded by a sparse checkout.
+func readRepoDir(name, treeish string, worktree bool) ([]string, bool, error) {
+	if entries, err := os.ReadDir(name); err == nil {
+		var names []string
+		for _, e := range entries {
+			if !e.IsDir() {
+				names = append(names, e.Name())
+			}
+		}
+		return names, true, nil
+	} else if _, err := os.Stat(name); err == nil || !filepath.IsLocal(name) {
+		// not a directory
+		return nil, false, nil
+	}
+
+	// git errors are ignored, see readRepoFile
+	name = filepath.ToSlash(name)
+	if worktree {
+		if names, ok, err := catFile.IndexDir(name, true); err == nil && ok {
+			return names, true, nil
+		}
+		return nil, false, nil
+	}
+	if treeish != "" {
+		if names, ok, err := catFile.Tree(treeish + ":" + name); err == nil && ok {
+			return names, true, nil
+		}
+	}
+	if names, ok, err := catFile.IndexDir(name, false); err == nil && ok {
+		return names, true, nil
+	}
+	if treeish == "" {
+		if names, ok, err := catFile.Tree("HEAD:" + name); err == nil && ok {
+			return names, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// gitRepository gives strongbox access to the repository in the current
+// directory, treeish is the tree being checked out if known. worktree is set
+// when encrypting, the key files deleted from the working tree aren't used.
+type gitRepository struct {
+	treeish  string
+	worktree bool
+}
+
+func (r gitRepository) ReadFile(name string) ([]byte, bool, error) {
+	return readRepoFile(name, r.treeish, r.worktree)
+}
+
+func (r gitRepository) ReadFileAtHEAD(name string) ([]byte, bool, error) {
+	return catFile.Object("HEAD:" + filepath.ToSlash(name))
+}
+
+func (r gitRepository) ReadDir(name string) ([]string, bool, error) {
+	return readRepoDir(name, r.treeish, r.worktree)
+}
+
+func (r gitRepository) ReadDirAtHEAD(name string) ([]string, bool, error) {
+	return catFile.Tree("HEAD:" + filepath.ToSlash(name))
+}
+
+// commitRepository reads files from a commit only, unlike gitRepository it
+// doesn't look at the working tree, eg in bare repositories
+type commitRepository struct {
+	commit string
+}
+
+func (r commitRepository) ReadFile(name string) ([]byte, bool, error) {
+	if !filepath.IsLocal(name) {
+		return nil, false, nil
+	}
+	return catFile.Object(r.commit + ":" + filepath.ToSlash(name))
+}
+
+func (r commitRepository) ReadFileAtHEAD(name string) ([]byte, bool, error) {
+	return catFile.Object("HEAD:" + filepath.ToSlash(name))
+}
+
+func (r commitRepository) ReadDir(name string) ([]string, bool, error) {
+	if !filepath.IsLocal(name) {
+		return nil, false, nil
+	}
+	return catFile.Tree(r.commit + ":" + filepath.ToSlash(name))
+}
+
+func (r commitRepository) ReadDirAtHEAD(name string) ([]string, bool, error) {
+	return catFile.Tree("HEAD:" + filepath.ToSlash(name))
+}
+
+var (
+	gitDirOnce sync.Once
+	gitDirPath string
+	gitDirErr  error
+)
+
+// gitDir returns the path of the `.git` directory of the current working tree
+func gitDir() (string, error) {
+	gitDirOnce.Do(func() {
+		out, err := exec.Command("git", "rev-parse", "--absolute-git-dir").Output()
+		if err != nil {
+			gitDirErr = fmt.Errorf("unable to find git directory: %w", err)
+			return
+		}
+		gitDirPath = strings.TrimSpace(string(out))
+	})
+	return gitDirPath, gitDirErr
+}
+
+// chdirTopLevel changes into the root of the working tree, git runs filters
+// from there and paths are relative to it
+func chdirTopLevel() error {
+	out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return fmt.Errorf("not in a git working tree: %w", err)
+	}
+	return os.Chdir(strings.TrimSpace(string(out)))
+}
+
+// strongboxFiles returns the tracked files with the `filter=strongbox`
+// attribute, it must be called from the root of the working tree
+func strongboxFiles() ([]string, error) {
+	files, err := exec.Command("git", "ls-files", "-z").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files failed: %w", err)
+	}
+	return checkAttrFilter(files, nil)
+}
+
+// checkAttrFilter returns which of the NUL separated paths have the
+// `filter=strongbox` attribute, env and args are passed to git check-attr
+func checkAttrFilter(paths []byte, env []string, args ...string) ([]string, error) {
+	checkAttr := exec.Command("git", append(append([]string{"check-attr", "-z", "--stdin"}, args...), "filter")...)
+	checkAttr.Env = append(os.Environ(), env...)
+	checkAttr.Stdin = bytes.NewReader(paths)
+	out, err := checkAttr.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git check-attr failed: %w", err)
+	}
+
+	// output is `<path> NUL <attribute> NUL <value> NUL` per file
+	var filtered []string
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		// unmerged files are listed once per stage
+		if len(filtered) > 0 && filtered[len(filtered)-1] == fields[i] {
+			continue
+		}
+		if fields[i+2] == "strongbox" {
+			filtered = append(filtered, fields[i])
+		}
+	}
+	return filtered, nil
+}
+
+// allowedSignersFile returns the SSH allowed_signers file git uses to verify
+// signatures relative to the root of the repository, empty if it isn't
+// configured. Files outside of the repository are an error, recipients
+// would differ between clones.
+func allowedSignersFile() (string, error) {
+	out, err := exec.Command("git", "config", "--path", "--get", "gpg.ssh.allowedSignersFile").Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		// not set
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to read gpg.ssh.allowedSignersFile: %w", err)
+	}
+	path := strings.TrimSpace(string(out))
+	if filepath.IsAbs(path) {
+		out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+		if err != nil {
+			return "", fmt.Errorf("not in a git working tree: %w", err)
+		}
+		top := strings.TrimSpace(string(out))
+		if rel, err := filepath.Rel(top, path); err == nil && filepath.IsLocal(rel) {
+			return rel, nil
+		}
+		return "", fmt.Errorf("gpg.ssh.allowedSignersFile %s is outside of the repository, reference a file of the repository with %s PATH", path, strongbox.AllowedSignersDirective)
+	}
+	return path, nil
+}
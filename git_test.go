@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+// setupTestRepo creates a new repository in a temporary directory and changes
+// into it, catFile is replaced so objects are read from the new repository
+func setupTestRepo(t *testing.T) string {
+	t.Helper()
+	repoDir := t.TempDir()
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(repoDir, ".gitconfig"))
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"config", "user.name", "strongbox-tester"},
+		{"config", "user.email", "strongbox-tester@example.com"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", repoDir}, args...)...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	t.Chdir(repoDir)
+
+	gitDirOnce = sync.Once{}
+	prevCatFile := catFile
+	catFile = &gitCatFile{}
+	t.Cleanup(func() {
+		catFile.Close()
+		catFile = prevCatFile
+	})
+	return repoDir
+}
+
+func mustGit(t *testing.T, args ...string) {
+	t.Helper()
+	out, err := exec.Command("git", args...).CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+func TestFindKeyFromGit(t *testing.T) {
+	setupTestRepo(t)
+
+	keyID := "ejDHqNvTRAvC1ZT0aiItGpnqEN8KaLGjeJOZXZt5fB8="
+	require.NoError(t, os.MkdirAll("secrets/app", 0o755))
+	require.NoError(t, os.WriteFile("secrets/.strongbox-keyid", []byte(keyID+"\n"), 0o644))
+	mustGit(t, "add", "secrets/.strongbox-keyid")
+
+	// only in the index
+	require.NoError(t, os.Remove("secrets/.strongbox-keyid"))
+	found, err := strongbox.FindKeyID(gitRepository{}, "secrets/app/secret")
+	require.NoError(t, err)
+	require.Equal(t, keyID, base64.StdEncoding.EncodeToString(found))
+	// deleted from the working tree, it's not used to encrypt
+	_, err = strongbox.FindKeyID(gitRepository{worktree: true}, "secrets/app/secret")
+	require.Error(t, err)
+	// unless it's excluded by a sparse checkout
+	mustGit(t, "update-index", "--skip-worktree", "secrets/.strongbox-keyid")
+	catFile.Close()
+	found, err = strongbox.FindKeyID(gitRepository{worktree: true}, "secrets/app/secret")
+	require.NoError(t, err)
+	require.Equal(t, keyID, base64.StdEncoding.EncodeToString(found))
+	mustGit(t, "update-index", "--no-skip-worktree", "secrets/.strongbox-keyid")
+
+	// only at HEAD
+	mustGit(t, "commit", "--quiet", "--message", "add key id")
+	mustGit(t, "rm", "--quiet", "--cached", "secrets/.strongbox-keyid")
+	// a running git cat-file doesn't notice ref updates
+	catFile.Close()
+	found, err = strongbox.FindKeyID(gitRepository{}, "secrets/app/secret")
+	require.NoError(t, err)
+	require.Equal(t, keyID, base64.StdEncoding.EncodeToString(found))
+
+	// only in the tree being checked out
+	mustGit(t, "commit", "--quiet", "--message", "remove key id")
+	catFile.Close()
+	_, err = strongbox.FindKeyID(gitRepository{}, "secrets/app/secret")
+	require.Error(t, err)
+	found, err = strongbox.FindKeyID(gitRepository{treeish: "HEAD~1"}, "secrets/app/secret")
+	require.NoError(t, err)
+	require.Equal(t, keyID, base64.StdEncoding.EncodeToString(found))
+}
+
+func TestFindRecipientDirFromGit(t *testing.T) {
+	setupTestRepo(t)
+
+	alice, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipientDir := filepath.Join("secrets", strongbox.RecipientDirname)
+	require.NoError(t, os.MkdirAll(filepath.Join(recipientDir, "old"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(recipientDir, "alice.pub"), []byte(alice.Recipient().String()+"\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(recipientDir, "old", "bob.pub"), []byte("age1nope\n"), 0o644))
+	mustGit(t, "add", "secrets")
+	mustGit(t, "commit", "--quiet", "--message", "add recipients")
+
+	expectAlice := func(repo strongbox.Repository) {
+		t.Helper()
+		path, recipients, err := strongbox.FindRecipients("secrets/app/secret", strongbox.Options{Repository: repo})
+		require.NoError(t, err)
+		require.Equal(t, recipientDir, path)
+		require.Len(t, recipients, 1)
+		require.Equal(t, "alice", recipients[0].Name)
+	}
+	expectAlice(gitRepository{})
+
+	// only at HEAD, eg excluded by a sparse checkout
+	require.NoError(t, os.RemoveAll(recipientDir))
+	expectAlice(gitRepository{})
+	expectAlice(commitRepository{commit: "HEAD"})
+
+	// only in the tree being checked out
+	mustGit(t, "rm", "--quiet", "-r", "--cached", "secrets")
+	mustGit(t, "commit", "--quiet", "--message", "remove recipients")
+	catFile.Close()
+	path, _, err := strongbox.FindRecipients("secrets/app/secret", strongbox.Options{Repository: gitRepository{}})
+	require.NoError(t, err)
+	require.Empty(t, path)
+	expectAlice(gitRepository{treeish: "HEAD~1"})
+
+	// only in the index, eg during a checkout, it's found before the
+	// recipient file of the parent directory like a staged recipient file
+	bob, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join("secrets", strongbox.RecipientFilename), []byte(bob.Recipient().String()+"\n"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join("secrets", "app", strongbox.RecipientDirname), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join("secrets", "app", strongbox.RecipientDirname, "alice.pub"), []byte(alice.Recipient().String()+"\n"), 0o644))
+	mustGit(t, "add", "secrets")
+	require.NoError(t, os.RemoveAll(filepath.Join("secrets", "app")))
+	catFile.Close()
+	path, recipients, err := strongbox.FindRecipients("secrets/app/secret", strongbox.Options{Repository: gitRepository{}})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("secrets", "app", strongbox.RecipientDirname), path)
+	require.Len(t, recipients, 1)
+	require.Equal(t, "alice", recipients[0].Name)
+	// the recipients of the working tree are used to encrypt
+	path, _, err = strongbox.FindRecipients("secrets/app/secret", strongbox.Options{Repository: gitRepository{worktree: true}})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("secrets", strongbox.RecipientFilename), path)
+	mustGit(t, "update-index", "--skip-worktree", filepath.ToSlash(filepath.Join("secrets", "app", strongbox.RecipientDirname, "alice.pub")))
+	catFile.Close()
+	path, _, err = strongbox.FindRecipients("secrets/app/secret", strongbox.Options{Repository: gitRepository{worktree: true}})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("secrets", "app", strongbox.RecipientDirname), path)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// hookMarker identifies hooks written by install-hooks
+const hookMarker = "# installed by `strongbox install-hooks`"
+
+// chainedHookSuffix is appended to the name of existing hooks, they are run
+// after strongbox's checks pass
+const chainedHookSuffix = ".strongbox-chained"
+
+var hookScripts = map[string]string{
+	"pre-commit": `#!/bin/sh
+` + hookMarker + `
+strongbox -hook pre-commit || exit $?
+chained="$0` + chainedHookSuffix + `"
+if [ -x "$chained" ]; then
+	exec "$chained" "$@"
+fi
+`,
+	// pre-push reads the refs being pushed from stdin, keep them for the
+	// chained hook
+	"pre-push": `#!/bin/sh
+` + hookMarker + `
+input=$(cat; echo x)
+input=${input%x}
+printf '%s' "$input" | strongbox -hook pre-push "$@" || exit $?
+chained="$0` + chainedHookSuffix + `"
+if [ -x "$chained" ]; then
+	printf '%s' "$input" | "$chained" "$@"
+	exit $?
+fi
+`,
+}
+
+// installHooks installs the pre-commit and pre-push hooks in the hooks
+// directory, honouring core.hooksPath. Existing hooks are kept and run
+// after strongbox's checks.
+func installHooks(w io.Writer) error {
+	if err := chdirTopLevel(); err != nil {
+		return err
+	}
+	out, err := exec.Command("git", "rev-parse", "--git-path", "hooks").Output()
+	if err != nil {
+		return fmt.Errorf("unable to find hooks directory: %w", err)
+	}
+	dir := strings.TrimSpace(string(out))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"pre-commit", "pre-push"} {
+		path := filepath.Join(dir, name)
+		existing, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return err
+		case strings.Contains(string(existing), hookMarker):
+			// already installed, update it
+		default:
+			chained := path + chainedHookSuffix
+			if _, err := os.Stat(chained); err == nil {
+				return fmt.Errorf("both %s and %s exist, refusing to overwrite either", path, chained)
+			}
+			if err := os.Rename(path, chained); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "moved existing hook %s to %s, it's run after strongbox's checks\n", path, chained)
+		}
+		if err := os.WriteFile(path, []byte(hookScripts[name]), 0o755); err != nil {
+			return err
+		}
+		// WriteFile doesn't change the mode of existing files
+		if err := os.Chmod(path, 0o755); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "installed %s\n", path)
+	}
+	return nil
+}
+
+// runHook is called by the hooks, it fails if plaintext would be committed
+// or pushed
+func runHook(name string, stdin io.Reader, w io.Writer) error {
+	var rejected []string
+	var err error
+	switch name {
+	case "pre-commit":
+		rejected, err = verifyIndex()
+	case "pre-push":
+		rejected, err = verifyPush(stdin)
+	default:
+		return fmt.Errorf("unknown hook %q", name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(rejected) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(w, "strongbox: files with the filter=strongbox attribute aren't encrypted:\n")
+	for _, r := range rejected {
+		fmt.Fprintf(w, "\t%s\n", r)
+	}
+	fmt.Fprintf(w, "make sure `strongbox -git-config` was run and the files are encrypted before retrying\n")
+	return fmt.Errorf("%s rejected, %d file(s) not encrypted", name, len(rejected))
+}
+
+// verifyIndex returns the staged files which should be encrypted but aren't
+func verifyIndex() ([]string, error) {
+	head := "HEAD"
+	if err := exec.Command("git", "rev-parse", "--verify", "--quiet", "HEAD").Run(); err != nil {
+		// no commits yet
+		if head, err = emptyTree(); err != nil {
+			return nil, err
+		}
+	}
+	blobs, err := changedBlobs("diff-index", "--cached", "-r", "-z", "--no-renames", head)
+	if err != nil {
+		return nil, err
+	}
+	return checkBlobs("", blobs, isEncrypted)
+}
+
+// verifyPush reads the `<local ref> <local oid> <remote ref> <remote oid>`
+// lines git passes to pre-push hooks and returns the pushed files which
+// should be encrypted but aren't
+func verifyPush(r io.Reader) ([]string, error) {
+	var plaintext []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 {
+			continue
+		}
+		local, remote := fields[1], fields[3]
+		if isZeroOID(local) {
+			// deleting the remote ref
+			continue
+		}
+		revs := []string{local, "--not", "--remotes"}
+		if !isZeroOID(remote) && exec.Command("git", "cat-file", "-e", remote+"^{commit}").Run() == nil {
+			revs = []string{local, "--not", remote}
+		}
+		p, err := verifyCommits(isEncrypted, revs...)
+		if err != nil {
+			return nil, err
+		}
+		plaintext = append(plaintext, p...)
+	}
+	return plaintext, scanner.Err()
+}
+
+func isZeroOID(oid string) bool {
+	return strings.Trim(oid, "0") == ""
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+func TestInstallHooks(t *testing.T) {
+	repoDir := setupTestRepo(t)
+	mustGit(t, "config", "core.hooksPath", "hooks")
+	require.NoError(t, os.MkdirAll("hooks", 0o755))
+	require.NoError(t, os.WriteFile("hooks/pre-commit", []byte("#!/bin/sh\necho existing\n"), 0o755))
+
+	var out bytes.Buffer
+	require.NoError(t, installHooks(&out))
+	// installing again only updates the hooks
+	require.NoError(t, installHooks(&out))
+
+	for _, name := range []string{"pre-commit", "pre-push"} {
+		hook, err := os.ReadFile(filepath.Join(repoDir, "hooks", name))
+		require.NoError(t, err)
+		require.Contains(t, string(hook), "strongbox -hook "+name)
+	}
+	chained, err := os.ReadFile(filepath.Join(repoDir, "hooks", "pre-commit"+chainedHookSuffix))
+	require.NoError(t, err)
+	require.Equal(t, "#!/bin/sh\necho existing\n", string(chained))
+	require.NoFileExists(t, filepath.Join(repoDir, "hooks", "pre-push"+chainedHookSuffix))
+}
+
+func TestHooksRejectPlaintext(t *testing.T) {
+	encrypted := ageEncryptTest(t, "secret\n", testRecipients(t)...)
+	setupTestRepo(t)
+	addTestFiles(t, map[string][]byte{
+		".gitattributes":   []byte("secret* filter=strongbox\n"),
+		"secret-encrypted": encrypted,
+		"public":           []byte("public\n"),
+	})
+
+	var out bytes.Buffer
+	require.NoError(t, runHook("pre-commit", nil, &out))
+	mustGit(t, "commit", "--quiet", "--message", "encrypted")
+	head := revParse(t, "HEAD")
+
+	require.NoError(t, os.WriteFile("secret-plain", []byte("secret\n"), 0o644))
+	mustGit(t, "add", "secret-plain")
+	require.Error(t, runHook("pre-commit", nil, &out))
+	require.Contains(t, out.String(), "\tsecret-plain: not encrypted\n")
+
+	mustGit(t, "commit", "--quiet", "--no-verify", "--message", "plaintext")
+	zero := strings.Repeat("0", len(head))
+	push := func(local, remote string) error {
+		out.Reset()
+		stdin := strings.NewReader("refs/heads/main " + local + " refs/heads/main " + remote + "\n")
+		return runHook("pre-push", stdin, &out)
+	}
+	require.NoError(t, push(head, zero))
+	require.Error(t, push(revParse(t, "HEAD"), head))
+	require.Contains(t, out.String(), revParse(t, "HEAD")+" secret-plain: not encrypted\n")
+	require.NotContains(t, out.String(), "secret-encrypted")
+	require.Error(t, push(revParse(t, "HEAD"), zero))
+	// deleting a branch pushes nothing
+	require.NoError(t, push(zero, revParse(t, "HEAD")))
+}
+
+func TestHooksAcceptUnencryptedSubtree(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	setupTestRepo(t)
+	require.NoError(t, os.MkdirAll("secrets/public", 0o755))
+	require.NoError(t, os.WriteFile(".gitattributes", []byte("secrets/** filter=strongbox\n"), 0o644))
+	require.NoError(t, os.WriteFile("secrets/"+strongbox.RecipientFilename, []byte(identity.Recipient().String()+"\n"), 0o644))
+	require.NoError(t, os.WriteFile("secrets/public/"+strongbox.RecipientFilename, []byte(strongbox.NoneDirective+"\n"), 0o644))
+	require.NoError(t, os.WriteFile("secrets/public/readme", []byte("public\n"), 0o644))
+	mustGit(t, "add", ".gitattributes", "secrets/public")
+
+	var out bytes.Buffer
+	require.NoError(t, runHook("pre-commit", nil, &out))
+	mustGit(t, "commit", "--quiet", "--message", "public")
+	zero := strings.Repeat("0", len(revParse(t, "HEAD")))
+	stdin := strings.NewReader("refs/heads/main " + revParse(t, "HEAD") + " refs/heads/main " + zero + "\n")
+	require.NoError(t, runHook("pre-push", stdin, &out))
+	require.NoError(t, verifyReceive([]string{zero, revParse(t, "HEAD"), "refs/heads/main"}, nil, &out))
+
+	// the rest of the directory is still encrypted
+	require.NoError(t, os.WriteFile("secrets/password", []byte("secret\n"), 0o644))
+	mustGit(t, "add", "secrets")
+	require.Error(t, runHook("pre-commit", nil, &out))
+	require.Contains(t, out.String(), "\tsecrets/password: not encrypted\n")
+}
+
+func revParse(t *testing.T, rev string) string {
+	t.Helper()
+	out, err := exec.Command("git", "rev-parse", rev).Output()
+	require.NoError(t, err)
+	return strings.TrimSpace(string(out))
+}
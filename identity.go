@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+// identityCommand is `strongbox identity <command>`, it manages the identity
+// file
+func identityCommand(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: strongbox identity list|describe|remove|check|encrypt|export|import")
+	}
+	switch args[0] {
+	case "list":
+		return listIdentities(w)
+	case "describe":
+		return describeIdentity(w, args[1:])
+	case "remove":
+		return removeIdentity(w, args[1:])
+	case "check":
+		return checkIdentityFile(w, args[1:], confirm)
+	case "encrypt":
+		return encryptIdentityFile(w)
+	case "export":
+		return exportIdentities(w, args[1:])
+	case "import":
+		return importIdentities(w, os.Stdin, args[1:])
+	}
+	return fmt.Errorf("unknown identity command %q", args[0])
+}
+
+// encryptIdentityFile encrypts the plaintext identity file in place with a
+// passphrase, it's `strongbox identity encrypt`
+func encryptIdentityFile(w io.Writer) error {
+	content, err := os.ReadFile(identityFilename)
+	if err != nil {
+		return err
+	}
+	if strongbox.IsPassphraseProtected(content) {
+		return fmt.Errorf("%s is already passphrase protected", identityFilename)
+	}
+	if _, err := strongbox.ParseIdentities(bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("unable to parse %s: %w", identityFilename, err)
+	}
+	passphrase, err := newPassphrase(fmt.Sprintf("Enter new passphrase for %s: ", identityFilename))
+	if err != nil {
+		return err
+	}
+	if err := editIdentityFile(passphrase, func(content []byte) ([]byte, error) { return content, nil }); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s is now passphrase protected\n", identityFilename)
+	return nil
+}
+
+// identityEntry is an identity of the identity file and the comments
+// ageGenIdentity writes before it
+type identityEntry struct {
+	Description string
+	PublicKey   string
+	Identity    string
+
+	// first and last are the indexes of the lines of the entry in the
+	// identity file, from its comments to the identity, description is the
+	// index of the description comment or -1
+	first, last, description int
+}
+
+func (e identityEntry) String() string {
+	var b strings.Builder
+	if e.Description != "" {
+		fmt.Fprintf(&b, "# description: %s\n", e.Description)
+	}
+	if e.PublicKey != "" {
+		fmt.Fprintf(&b, "# public key: %s\n", e.PublicKey)
+	}
+	b.WriteString(e.Identity + "\n")
+	return b.String()
+}
+
+// recipient returns the public key of the identity, from the public key
+// comment if it can't be derived, eg for plugin identities
+func (e identityEntry) recipient() string {
+	if identity, err := age.ParseX25519Identity(e.Identity); err == nil {
+		return identity.Recipient().String()
+	}
+	return e.PublicKey
+}
+
+// name returns the public key of the identity, or its description if the
+// public key isn't known
+func (e identityEntry) name() string {
+	if r := e.recipient(); r != "" {
+		return r
+	}
+	return e.Description
+}
+
+// parseIdentityEntries returns the identities of the plaintext content of an
+// identity file, the description and public key comments before an identity
+// belong to it
+func parseIdentityEntries(content []byte) ([]identityEntry, error) {
+	if strongbox.IsSSHPrivateKey(content) {
+		return nil, errors.New("identity file holds a SSH key, not age identities")
+	}
+	var entries []identityEntry
+	entry := identityEntry{first: -1, description: -1}
+	for i, line := range identityFileLines(content) {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "# description:"):
+			entry.Description = strings.TrimSpace(strings.TrimPrefix(line, "# description:"))
+			entry.description = i
+		case strings.HasPrefix(line, "# public key:"):
+			entry.PublicKey = strings.TrimSpace(strings.TrimPrefix(line, "# public key:"))
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		default:
+			entry.Identity = line
+			if entry.first == -1 {
+				entry.first = i
+			}
+			entry.last = i
+			entries = append(entries, entry)
+			entry = identityEntry{first: -1, description: -1}
+			continue
+		}
+		if entry.first == -1 {
+			entry.first = i
+		}
+	}
+	return entries, nil
+}
+
+// parseIdentityLine parses an age identity, either X25519 or a plugin
+// identity
+func parseIdentityLine(s string) (age.Identity, error) {
+	if strings.HasPrefix(s, "AGE-PLUGIN-") {
+		return plugin.NewIdentity(s, pluginUI)
+	}
+	return age.ParseX25519Identity(s)
+}
+
+// appendIdentityEntries appends entries to the plaintext content of an
+// identity file
+func appendIdentityEntries(content []byte, entries []identityEntry) []byte {
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		content = append(content, '\n')
+	}
+	for _, entry := range entries {
+		content = append(content, entry.String()...)
+	}
+	return content
+}
+
+// identityFileLines splits content in lines, without the final newline
+func identityFileLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// joinIdentityFileLines is the inverse of identityFileLines
+func joinIdentityFileLines(lines []string) []byte {
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// matchIdentityEntries returns the entries whose public key or description is
+// name
+func matchIdentityEntries(entries []identityEntry, name string) []identityEntry {
+	var matched []identityEntry
+	for _, e := range entries {
+		if e.recipient() == name || (e.Description != "" && e.Description == name) {
+			matched = append(matched, e)
+		}
+	}
+	return matched
+}
+
+// findIdentityEntries returns the entries of the identity matching name, see
+// matchIdentityEntries, including its duplicates. name must match a single
+// identity.
+func findIdentityEntries(entries []identityEntry, name string) ([]identityEntry, error) {
+	matched := matchIdentityEntries(entries, name)
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no identity %q in %s", name, identityFilename)
+	}
+	for _, e := range matched[1:] {
+		if e.Identity != matched[0].Identity {
+			return nil, fmt.Errorf("%q matches %d identities, use the public key", name, len(matched))
+		}
+	}
+	var found []identityEntry
+	for _, e := range entries {
+		if e.Identity == matched[0].Identity {
+			found = append(found, e)
+		}
+	}
+	return found, nil
+}
+
+// listIdentities writes the public key and description of every identity of
+// the identity file, it's `strongbox identity list`
+func listIdentities(w io.Writer) error {
+	content, _, err := readIdentityFile()
+	if err != nil {
+		return err
+	}
+	entries, err := parseIdentityEntries(content)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PUBLIC KEY\tDESCRIPTION")
+	for _, e := range entries {
+		recipient, description := e.recipient(), e.Description
+		if recipient == "" {
+			recipient = "-"
+		}
+		if description == "" {
+			description = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", recipient, description)
+	}
+	return tw.Flush()
+}
+
+// describeIdentity sets the description comment of the identity whose public
+// key or description is args[0], it's `strongbox identity describe`
+func describeIdentity(w io.Writer, args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: strongbox identity describe DESCRIPTION|PUBLIC_KEY NEW_DESCRIPTION")
+	}
+	name, description := args[0], strings.Join(args[1:], " ")
+	var changed []identityEntry
+	err := editIdentityFile(nil, func(content []byte) ([]byte, error) {
+		entries, err := parseIdentityEntries(content)
+		if err != nil {
+			return nil, err
+		}
+		if changed, err = findIdentityEntries(entries, name); err != nil {
+			return nil, err
+		}
+		lines := identityFileLines(content)
+		// from the end, inserted lines move the following ones
+		for _, e := range slices.Backward(changed) {
+			comment := "# description: " + description
+			if e.description >= 0 {
+				lines[e.description] = comment
+			} else {
+				lines = slices.Insert(lines, e.first, comment)
+			}
+		}
+		return joinIdentityFileLines(lines), nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "described %s as %q\n", changed[0].name(), description)
+	return nil
+}
+
+// removeIdentity removes the identity whose public key or description is
+// args[0], with its comments, it's `strongbox identity remove`
+func removeIdentity(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: strongbox identity remove DESCRIPTION|PUBLIC_KEY")
+	}
+	var removed []identityEntry
+	err := editIdentityFile(nil, func(content []byte) ([]byte, error) {
+		entries, err := parseIdentityEntries(content)
+		if err != nil {
+			return nil, err
+		}
+		if removed, err = findIdentityEntries(entries, args[0]); err != nil {
+			return nil, err
+		}
+		lines := identityFileLines(content)
+		for _, e := range slices.Backward(removed) {
+			lines = slices.Delete(lines, e.first, e.last+1)
+		}
+		return joinIdentityFileLines(lines), nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "removed %s from %s\n", removed[0].name(), identityFilename)
+	return nil
+}
+
+// checkIdentityFile audits the identity file for permissions which let others
+// read it, identities which can't be parsed and duplicates, it's
+// `strongbox identity check [-fix]`. The mode is fixed with -fix, or if
+// confirm returns true.
+func checkIdentityFile(w io.Writer, args []string, confirm func(prompt string) bool) error {
+	flags := flag.NewFlagSet("identity check", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "Change the mode of the identity file to 0600 without asking")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(identityFilename)
+	if err != nil {
+		return err
+	}
+	var problems int
+	report := func(format string, args ...any) {
+		problems++
+		fmt.Fprintf(w, "%s: %s\n", identityFilename, fmt.Sprintf(format, args...))
+	}
+	if mode := fi.Mode().Perm(); mode&0o077 != 0 {
+		report("mode %04o lets other users read it, it should be 0600", mode)
+		if *fix || confirm(fmt.Sprintf("Change the mode of %s to 0600? [y/N] ", identityFilename)) {
+			if err := os.Chmod(identityFilename, 0o600); err != nil {
+				return err
+			}
+			problems--
+			fmt.Fprintf(w, "%s: mode changed to 0600\n", identityFilename)
+		}
+	}
+
+	content, _, err := readIdentityFile()
+	if err != nil {
+		return err
+	}
+	if strongbox.IsSSHPrivateKey(content) {
+		if _, err := strongbox.ParseSSHIdentity(content, func() ([]byte, error) { return nil, nil }); err != nil {
+			report("unable to parse SSH key: %s", err)
+		}
+	} else {
+		entries, err := parseIdentityEntries(content)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			report("no identities found")
+		}
+		seen := map[string]int{}
+		for _, e := range entries {
+			line := e.last + 1
+			if _, err := parseIdentityLine(e.Identity); err != nil {
+				// the error doesn't include the secret key
+				report("line %d: unable to parse identity: %s", line, err)
+				continue
+			}
+			if first, ok := seen[e.Identity]; ok {
+				report("line %d: duplicate of the identity at line %d", line, first)
+				continue
+			}
+			seen[e.Identity] = line
+			if e.PublicKey != "" && e.PublicKey != e.recipient() {
+				report("line %d: public key comment %s doesn't match the identity %s", line, e.PublicKey, e.recipient())
+			}
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problems found in %s", problems, identityFilename)
+	}
+	fmt.Fprintf(w, "%s: no problems found\n", identityFilename)
+	return nil
+}
+
+// confirm asks the user a yes or no question on the terminal, false if there
+// is none
+func confirm(prompt string) bool {
+	answer, err := readLine(prompt)
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes"
+}
+
+// identityFilePassphrase is the passphrase of the identity file once it was
+// decrypted by readIdentityFile, it's only prompted for once
+var identityFilePassphrase []byte
+
+// readIdentityFile returns the plaintext content of the identity file and its
+// passphrase, which is prompted for if it's protected and nil otherwise
+func readIdentityFile() (content, passphrase []byte, err error) {
+	content, err = os.ReadFile(identityFilename)
+	if err != nil || !strongbox.IsPassphraseProtected(content) {
+		return content, nil, err
+	}
+	passphrase = identityFilePassphrase
+	if passphrase == nil {
+		if passphrase, err = readPassphrase(fmt.Sprintf("Enter passphrase for %s: ", identityFilename)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if content, err = strongbox.DecryptIdentityFile(content, passphrase); err != nil {
+		return nil, nil, fmt.Errorf("unable to decrypt %s: %w", identityFilename, err)
+	}
+	identityFilePassphrase = passphrase
+	return content, passphrase, nil
+}
+
+// exportIdentities writes a backup of the identities of the identity file, or
+// of the one whose description or public key is args[0], it's
+// `strongbox identity export`
+func exportIdentities(w io.Writer, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: strongbox identity export [DESCRIPTION|PUBLIC_KEY]")
+	}
+	content, _, err := readIdentityFile()
+	if err != nil {
+		return err
+	}
+	entries, err := parseIdentityEntries(content)
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		entries = slices.DeleteFunc(entries, func(e identityEntry) bool {
+			return e.Description != args[0] && e.recipient() != args[0]
+		})
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no identities to export in %s", identityFilename)
+	}
+	backup, err := encodeBackup(entries)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, backup)
+	return err
+}
+
+// importIdentities adds the identities of a backup, read from args[0] or
+// stdin, to the identity file, it's `strongbox identity import`. Identities
+// which are already in the identity file are skipped.
+func importIdentities(w io.Writer, stdin io.Reader, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: strongbox identity import [FILE]")
+	}
+	r := stdin
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	entries, err := decodeBackup(r)
+	if err != nil {
+		return err
+	}
+
+	var added []identityEntry
+	err = editIdentityFile(nil, func(content []byte) ([]byte, error) {
+		existing, err := parseIdentityEntries(content)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if slices.ContainsFunc(existing, func(e identityEntry) bool { return e.Identity == entry.Identity }) {
+				fmt.Fprintf(w, "%s is already in %s\n", entry.name(), identityFilename)
+				continue
+			}
+			added = append(added, entry)
+		}
+		return appendIdentityEntries(content, added), nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range added {
+		fmt.Fprintf(w, "imported %s\n", entry.name())
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+// fakePinentry answers GETPIN with `pass%word`, percent encoded
+const fakePinentry = `#!/bin/sh
+echo "OK fake pinentry"
+while read -r command args; do
+	case "$command" in
+	GETPIN) echo "D pass%25word"; echo OK ;;
+	BYE) echo OK; exit 0 ;;
+	*) echo OK ;;
+	esac
+done
+`
+
+func TestPassphraseHelper(t *testing.T) {
+	dir := t.TempDir()
+	askpass := filepath.Join(dir, "askpass")
+	require.NoError(t, os.WriteFile(askpass, []byte("#!/bin/sh\necho \"pass for $1\"\n"), 0o755))
+	pinentry := filepath.Join(dir, "pinentry-fake")
+	require.NoError(t, os.WriteFile(pinentry, []byte(fakePinentry), 0o755))
+
+	t.Setenv("STRONGBOX_PASSPHRASE_HELPER", askpass)
+	passphrase, err := readPassphrase("prompt:")
+	require.NoError(t, err)
+	require.Equal(t, "pass for prompt:", string(passphrase))
+
+	t.Setenv("STRONGBOX_PASSPHRASE_HELPER", pinentry)
+	passphrase, err = readPassphrase("Enter passphrase\nfor 100% of files")
+	require.NoError(t, err)
+	require.Equal(t, "pass%word", string(passphrase))
+
+	t.Setenv("STRONGBOX_PASSPHRASE_HELPER", "false")
+	_, err = readPassphrase("prompt:")
+	require.Error(t, err)
+}
+
+func TestRepoPassphrase(t *testing.T) {
+	require.Equal(t, "STRONGBOX_PASSPHRASE", repoPassphraseEnv(""))
+	require.Equal(t, "STRONGBOX_PASSPHRASE_TEAM_A1", repoPassphraseEnv("team-a1"))
+
+	t.Setenv("STRONGBOX_PASSPHRASE_HELPER", "false")
+	t.Setenv("STRONGBOX_PASSPHRASE_OPS", "s3cret")
+	t.Setenv("STRONGBOX_PASSPHRASE_EMPTY", "")
+	passphrase, err := repoPassphrase("ops")
+	require.NoError(t, err)
+	require.Equal(t, "s3cret", string(passphrase))
+	_, err = repoPassphrase("empty")
+	require.Error(t, err)
+	_, err = repoPassphrase("unset")
+	require.Error(t, err)
+
+	// the passphrase is only read once
+	t.Setenv("STRONGBOX_PASSPHRASE_OPS", "changed")
+	passphrase, err = repoPassphrase("ops")
+	require.NoError(t, err)
+	require.Equal(t, "s3cret", string(passphrase))
+}
+
+func TestPassphraseProtectedIdentityFile(t *testing.T) {
+	dir := t.TempDir()
+	pinentry := filepath.Join(dir, "pinentry-fake")
+	require.NoError(t, os.WriteFile(pinentry, []byte(fakePinentry), 0o755))
+	t.Setenv("STRONGBOX_PASSPHRASE_HELPER", pinentry)
+
+	prevIdentityFilename := identityFilename
+	t.Cleanup(func() {
+		identityFilename = prevIdentityFilename
+		identitiesOnce = sync.Once{}
+	})
+	identityFilename = filepath.Join(dir, ".strongbox_identity")
+
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	ageGenIdentity("plaintext", false)
+	os.Stdout = stdout
+	fi, err := os.Stat(identityFilename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	plaintext, err := os.ReadFile(identityFilename)
+	require.NoError(t, err)
+	identities, err := strongbox.ParseIdentities(bytes.NewReader(plaintext))
+	require.NoError(t, err)
+	recipient := identities[0].(*age.X25519Identity).Recipient()
+
+	require.NoError(t, encryptIdentityFile(io.Discard))
+	protected, err := os.ReadFile(identityFilename)
+	require.NoError(t, err)
+	require.True(t, strongbox.IsPassphraseProtected(protected))
+	decrypted, err := strongbox.DecryptIdentityFile(protected, []byte("pass%word"))
+	require.NoError(t, err)
+	require.Equal(t, string(plaintext), string(decrypted))
+	fi, err = os.Stat(identityFilename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	err = encryptIdentityFile(io.Discard)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "already passphrase protected")
+
+	identitiesOnce = sync.Once{}
+	loaded, err := loadIdentities()
+	require.NoError(t, err)
+	var out strings.Builder
+	require.NoError(t, strongbox.Decrypt(bytes.NewReader(ageEncryptTest(t, "secret", recipient)), &out, loaded, nil))
+	require.Equal(t, "secret", out.String())
+}
+
+func TestIdentityBackup(t *testing.T) {
+	prevIdentityFilename := identityFilename
+	t.Cleanup(func() { identityFilename = prevIdentityFilename })
+	identityFilename = filepath.Join(t.TempDir(), ".strongbox_identity")
+
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	ageGenIdentity("laptop", false)
+	ageGenIdentity("ci: deploys", false)
+	os.Stdout = stdout
+	original, err := os.ReadFile(identityFilename)
+	require.NoError(t, err)
+
+	var backup strings.Builder
+	require.NoError(t, exportIdentities(&backup, nil))
+	require.Equal(t, 2, strings.Count(backup.String(), backupHeader))
+	require.NotContains(t, backup.String(), "AGE-SECRET-KEY-1Q", "the identity should be split in lines")
+
+	// restore to a new identity file, typed back in lower case
+	identityFilename = filepath.Join(t.TempDir(), ".strongbox_identity")
+	var out strings.Builder
+	require.NoError(t, importIdentities(&out, strings.NewReader(strings.ToLower(backup.String())), nil))
+	require.Equal(t, 2, strings.Count(out.String(), "imported"))
+	restored, err := os.ReadFile(identityFilename)
+	require.NoError(t, err)
+	require.Equal(t, string(original), string(restored))
+	fi, err := os.Stat(identityFilename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	// importing again changes nothing
+	out.Reset()
+	require.NoError(t, importIdentities(&out, strings.NewReader(backup.String()), nil))
+	require.Equal(t, 2, strings.Count(out.String(), "already in"))
+
+	var selected strings.Builder
+	require.NoError(t, exportIdentities(&selected, []string{"ci: deploys"}))
+	require.Equal(t, 1, strings.Count(selected.String(), backupHeader))
+
+	lines := strings.Split(selected.String(), "\n")
+	var dataLines []int
+	for i, line := range lines {
+		if strings.HasPrefix(line, " 1:") || strings.HasPrefix(line, " 2:") {
+			dataLines = append(dataLines, i)
+		}
+	}
+	require.Len(t, dataLines, 2)
+	corrupt := func(change func(lines []string)) error {
+		changed := slices.Clone(lines)
+		change(changed)
+		_, err := decodeBackup(strings.NewReader(strings.Join(changed, "\n")))
+		return err
+	}
+	// a typo
+	err = corrupt(func(lines []string) {
+		line := lines[dataLines[0]]
+		c := "Q"
+		if line[4] == 'Q' {
+			c = "P"
+		}
+		lines[dataLines[0]] = line[:4] + c + line[5:]
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "check data line 1")
+	// swapped lines
+	err = corrupt(func(lines []string) {
+		a, b := lines[dataLines[0]][4:], lines[dataLines[1]][4:]
+		lines[dataLines[0]], lines[dataLines[1]] = " 1: "+b, " 2: "+a
+	})
+	require.Error(t, err)
+	// a missing line
+	err = corrupt(func(lines []string) { lines[dataLines[1]] = "" })
+	require.Error(t, err)
+	// another public key
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	err = corrupt(func(lines []string) {
+		for i, line := range lines {
+			if strings.HasPrefix(line, "public key:") {
+				lines[i] = "public key: " + other.Recipient().String()
+			}
+		}
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't match")
+}
+
+func TestIdentityCommands(t *testing.T) {
+	prevIdentityFilename := identityFilename
+	t.Cleanup(func() { identityFilename = prevIdentityFilename })
+	identityFilename = filepath.Join(t.TempDir(), ".strongbox_identity")
+
+	var generated []*age.X25519Identity
+	var content strings.Builder
+	for _, desc := range []string{"laptop", "ci"} {
+		identity, err := age.GenerateX25519Identity()
+		require.NoError(t, err)
+		generated = append(generated, identity)
+		content.WriteString(identityEntry{Description: desc, PublicKey: identity.Recipient().String(), Identity: identity.String()}.String())
+	}
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	laptop, ci := generated[0].Recipient().String(), generated[1].Recipient().String()
+	content.WriteString("\n# copied from the old laptop\n" + generated[0].String() + "\n")
+	content.WriteString("AGE-SECRET-KEY-1NOPE\n")
+	content.WriteString("# public key: " + other.Recipient().String() + "\n" + generated[1].String() + "\n")
+	require.NoError(t, os.WriteFile(identityFilename, []byte(content.String()), 0o644))
+
+	var out strings.Builder
+	require.NoError(t, identityCommand(&out, []string{"list"}))
+	require.Contains(t, out.String(), laptop+"  laptop")
+	require.Contains(t, out.String(), ci+"  ci")
+
+	out.Reset()
+	var asked []string
+	err = checkIdentityFile(&out, nil, func(prompt string) bool {
+		asked = append(asked, prompt)
+		return true
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "3 problems")
+	require.Len(t, asked, 1)
+	for _, problem := range []string{
+		"mode changed to 0600",
+		"line 9: duplicate of the identity at line 3",
+		"line 10: unable to parse identity",
+		"line 12: duplicate of the identity at line 6",
+	} {
+		require.Contains(t, out.String(), problem)
+	}
+	require.NotContains(t, out.String(), "NOPE", "identities shouldn't be printed")
+	fi, err := os.Stat(identityFilename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	// both copies of the identity are removed with their comments
+	out.Reset()
+	require.NoError(t, identityCommand(&out, []string{"remove", "laptop"}))
+	require.Equal(t, "removed "+laptop+" from "+identityFilename+"\n", out.String())
+	require.Error(t, identityCommand(&out, []string{"remove", "laptop"}))
+	require.NoError(t, identityCommand(&out, []string{"remove", ci}))
+	remaining, err := os.ReadFile(identityFilename)
+	require.NoError(t, err)
+	require.Equal(t, "\n# copied from the old laptop\nAGE-SECRET-KEY-1NOPE\n", string(remaining))
+
+	require.NoError(t, os.WriteFile(identityFilename, []byte("# description: ci\n"+other.String()+"\n"+content.String()), 0o600))
+	require.Error(t, identityCommand(&out, []string{"remove", "ci"}), "ci matches different identities")
+	require.NoError(t, identityCommand(&out, []string{"describe", laptop, "old", "laptop"}))
+	entries, err := parseIdentityEntries(mustReadFile(t, identityFilename))
+	require.NoError(t, err)
+	var descriptions []string
+	for _, e := range entries {
+		descriptions = append(descriptions, e.Description)
+	}
+	require.Equal(t, []string{"ci", "old laptop", "ci", "old laptop", "", ""}, descriptions)
+
+	// concurrent edits aren't lost
+	identityFilename = filepath.Join(t.TempDir(), ".strongbox_identity")
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			identity, err := age.GenerateX25519Identity()
+			if err == nil {
+				err = addIdentityEntries([]identityEntry{{Identity: identity.String()}}, false)
+			}
+			require.NoError(t, err)
+		})
+	}
+	wg.Wait()
+	entries, err = parseIdentityEntries(mustReadFile(t, identityFilename))
+	require.NoError(t, err)
+	require.Len(t, entries, 10)
+	out.Reset()
+	require.NoError(t, checkIdentityFile(&out, nil, nil))
+	require.Contains(t, out.String(), "no problems found")
+}
+
+func mustReadFile(t *testing.T, name string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(name)
+	require.NoError(t, err)
+	return content
+}
@@ -1,12 +1,7 @@
 package main
 
 import (
-	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-
-	"gopkg.in/yaml.v2"
+	"sync"
 )
 
 type keyRing interface {
@@ -14,71 +9,35 @@ type keyRing interface {
 	Save() error
 	AddKey(name string, keyID []byte, key []byte)
 	Key(keyID []byte) ([]byte, error)
+	Keys() ([][]byte, error)
 }
 
-type fileKeyRing struct {
-	fileName   string
-	KeyEntries []keyEntry
-}
-
-type keyEntry struct {
-	Description string `yaml:"description"`
-	KeyID       string `yaml:"key-id"`
-	Key         string `yaml:"key"`
+// cachedKeyRing only loads the underlying keyRing once, and only when a key
+// is needed, so a missing keyring only matters for siv files and the
+// long running filter process doesn't re-read it for every file
+type cachedKeyRing struct {
+	keyRing
+	once sync.Once
+	err  error
 }
 
-func (kr *fileKeyRing) AddKey(desc string, keyID []byte, key []byte) {
-	kr.KeyEntries = append(kr.KeyEntries, keyEntry{
-		Description: desc,
-		KeyID:       string(encode(keyID[:])),
-		Key:         string(encode(key[:])),
+func (c *cachedKeyRing) Load() error {
+	c.once.Do(func() {
+		c.err = c.keyRing.Load()
 	})
+	return c.err
 }
 
-func (kr *fileKeyRing) Key(keyID []byte) ([]byte, error) {
-	b64 := string(encode(keyID[:]))
-
-	for _, ke := range kr.KeyEntries {
-		if ke.KeyID == b64 {
-			dec, err := decode([]byte(ke.Key))
-			if err != nil {
-				return []byte{}, err
-			}
-			if len(dec) != 32 {
-				return []byte{}, fmt.Errorf("unexpected length of key: %d", len(dec))
-			}
-			return dec, nil
-		}
+func (c *cachedKeyRing) Key(keyID []byte) ([]byte, error) {
+	if err := c.Load(); err != nil {
+		return []byte{}, err
 	}
-
-	return []byte{}, errKeyNotFound
+	return c.keyRing.Key(keyID)
 }
 
-func (kr *fileKeyRing) Load() error {
-
-	bytes, err := os.ReadFile(kr.fileName)
-	if err != nil {
-		return err
+func (c *cachedKeyRing) Keys() ([][]byte, error) {
+	if err := c.Load(); err != nil {
+		return nil, err
 	}
-
-	err = yaml.Unmarshal(bytes, kr)
-	return err
-}
-
-func (kr *fileKeyRing) Save() error {
-	ser, err := yaml.Marshal(kr)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	path := filepath.Dir(kr.fileName)
-	_, err = os.Stat(path)
-	if os.IsNotExist(err) {
-		err := os.MkdirAll(path, 0700)
-		if err != nil {
-			return fmt.Errorf("error creating strongbox home folder: %s", err)
-		}
-	}
-
-	return os.WriteFile(kr.fileName, ser, 0600)
+	return c.keyRing.Keys()
 }
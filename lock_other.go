@@ -0,0 +1,35 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// lockTimeout is how long lockFile waits for the lock
+const lockTimeout = 10 * time.Second
+
+// lockFile takes an exclusive lock of path by creating it and returns the
+// function releasing it, by removing it. A lock left behind by a process
+// which crashed has to be removed by hand.
+func lockFile(path string) (unlock func(), err error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s exists, remove it if no strongbox process is running", path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
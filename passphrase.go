@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"golang.org/x/term"
+)
+
+// readPassphrase prompts for a passphrase with the passphrase helper if one
+// is configured, otherwise on the terminal. /dev/tty is used as git filters
+// don't have one on stdin.
+func readPassphrase(prompt string) ([]byte, error) {
+	if helper := passphraseHelper(); helper != "" {
+		return runPassphraseHelper(helper, prompt)
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prompt for passphrase: %w", err)
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, prompt)
+	passphrase, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read passphrase: %w", err)
+	}
+	return passphrase, nil
+}
+
+// newPassphrase prompts twice for a new passphrase
+func newPassphrase(prompt string) ([]byte, error) {
+	passphrase, err := readPassphrase(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	confirm, err := readPassphrase("Confirm passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, confirm) {
+		return nil, errors.New("passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+var (
+	repoPassphrasesMu sync.Mutex
+	repoPassphrases   = map[string]repoPassphraseResult{}
+)
+
+type repoPassphraseResult struct {
+	passphrase []byte
+	err        error
+}
+
+// repoPassphrase returns the passphrase of a `@passphrase [name]` recipient,
+// from $STRONGBOX_PASSPHRASE (or $STRONGBOX_PASSPHRASE_<NAME>) or prompted for
+// once per process
+func repoPassphrase(name string) ([]byte, error) {
+	repoPassphrasesMu.Lock()
+	defer repoPassphrasesMu.Unlock()
+	if r, ok := repoPassphrases[name]; ok {
+		return r.passphrase, r.err
+	}
+
+	var r repoPassphraseResult
+	if v, ok := os.LookupEnv(repoPassphraseEnv(name)); ok {
+		r.passphrase = []byte(v)
+	} else {
+		prompt := "Enter repository passphrase: "
+		if name != "" {
+			prompt = fmt.Sprintf("Enter repository passphrase %q: ", name)
+		}
+		r.passphrase, r.err = readPassphrase(prompt)
+	}
+	if r.err == nil && len(r.passphrase) == 0 {
+		r.err = errors.New("empty passphrase")
+	}
+	repoPassphrases[name] = r
+	return r.passphrase, r.err
+}
+
+// repoPassphraseEnv returns the environment variable holding the passphrase
+// with name, eg STRONGBOX_PASSPHRASE_TEAM_A for team-a
+func repoPassphraseEnv(name string) string {
+	if name == "" {
+		return "STRONGBOX_PASSPHRASE"
+	}
+	return "STRONGBOX_PASSPHRASE_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// passphraseHelper returns the command used to prompt for passphrases, set
+// by $STRONGBOX_PASSPHRASE_HELPER or `git config strongbox.passphraseHelper`
+func passphraseHelper() string {
+	if helper, ok := os.LookupEnv("STRONGBOX_PASSPHRASE_HELPER"); ok {
+		return helper
+	}
+	out, err := exec.Command("git", "config", "--get", "strongbox.passphraseHelper").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// runPassphraseHelper runs helper with the shell. pinentry programs are
+// spoken to with the Assuan protocol, other helpers are called like
+// SSH_ASKPASS, with the prompt as argument, and print the passphrase.
+func runPassphraseHelper(helper, prompt string) ([]byte, error) {
+	if fields := strings.Fields(helper); len(fields) > 0 && strings.HasPrefix(filepath.Base(fields[0]), "pinentry") {
+		return runPinentry(helper, prompt)
+	}
+	cmd := exec.Command("sh", "-c", helper+` "$1"`, "strongbox", prompt)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("passphrase helper %q failed: %w", helper, err)
+	}
+	return bytes.TrimRight(out, "\r\n"), nil
+}
+
+// runPinentry asks a pinentry program for the passphrase
+func runPinentry(helper, prompt string) ([]byte, error) {
+	cmd := exec.Command("sh", "-c", helper)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to run %q: %w", helper, err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	r := bufio.NewReader(stdout)
+	// response reads lines until OK, data lines are returned
+	response := func() ([]byte, error) {
+		var data []byte
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", helper, err)
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case line == "OK" || strings.HasPrefix(line, "OK "):
+				return data, nil
+			case strings.HasPrefix(line, "ERR"):
+				return nil, fmt.Errorf("%s: %s", helper, line)
+			case strings.HasPrefix(line, "D "):
+				decoded, err := url.PathUnescape(line[2:])
+				if err != nil {
+					return nil, fmt.Errorf("%s: malformed data: %w", helper, err)
+				}
+				data = append(data, decoded...)
+			}
+		}
+	}
+	if _, err := response(); err != nil {
+		return nil, err
+	}
+	for _, command := range []string{
+		"SETDESC " + pinentryEscape(prompt),
+		"SETPROMPT Passphrase:",
+		"SETTITLE strongbox",
+	} {
+		fmt.Fprintln(stdin, command)
+		if _, err := response(); err != nil {
+			return nil, err
+		}
+	}
+	fmt.Fprintln(stdin, "GETPIN")
+	passphrase, err := response()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(stdin, "BYE")
+	return passphrase, nil
+}
+
+// pinentryEscape percent encodes the characters Assuan doesn't allow in
+// arguments
+func pinentryEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// readLine prompts for a value on the terminal, the input is echoed
+func readLine(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("unable to prompt: %w", err)
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("unable to read input: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// pluginUI lets age plugins talk to the user through the terminal, messages
+// go to stderr as stdout is the filter's output
+var pluginUI = &plugin.ClientUI{
+	DisplayMessage: func(name, message string) error {
+		fmt.Fprintf(os.Stderr, "age-plugin-%s: %s\n", name, message)
+		return nil
+	},
+	RequestValue: func(name, prompt string, secret bool) (string, error) {
+		prompt = fmt.Sprintf("age-plugin-%s: %s ", name, prompt)
+		if !secret {
+			return readLine(prompt)
+		}
+		value, err := readPassphrase(prompt)
+		return string(value), err
+	},
+	Confirm: func(name, prompt, yes, no string) (bool, error) {
+		if no == "" {
+			_, err := readLine(fmt.Sprintf("age-plugin-%s: %s [press enter to %s] ", name, prompt, yes))
+			return err == nil, err
+		}
+		for {
+			answer, err := readLine(fmt.Sprintf("age-plugin-%s: %s [%s/%s] ", name, prompt, yes, no))
+			if err != nil {
+				return false, err
+			}
+			switch answer {
+			case yes:
+				return true, nil
+			case no:
+				return false, nil
+			}
+		}
+	},
+	WaitTimer: func(name string) {
+		fmt.Fprintf(os.Stderr, "age-plugin-%s: waiting on the plugin, eg for a hardware token to be touched...\n", name)
+	},
+}
+
+// lockedIdentity serialises Unwrap calls, identities which prompt for a
+// passphrase, or plugins which may interact with the user, aren't safe to use
+// concurrently and the filter process decrypts files in parallel
+type lockedIdentity struct {
+	mu sync.Mutex
+	age.Identity
+}
+
+// Unlock unlocks the underlying identity upfront if it supports it, see
+// strongbox.NewPassphraseProtectedIdentity
+func (i *lockedIdentity) Unlock() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if u, ok := i.Identity.(interface{ Unlock() error }); ok {
+		return u.Unlock()
+	}
+	return nil
+}
+
+func (i *lockedIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.Identity.Unwrap(stanzas)
+}
@@ -0,0 +1,353 @@
+package strongbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"filippo.io/age/plugin"
+	"golang.org/x/crypto/ssh"
+)
+
+// ParseIdentities parses an identity file, eg `$HOME/.strongbox_identity`,
+// holding either age identities or a SSH private key. Use ParseSSHIdentity
+// for passphrase protected SSH keys, NewPassphraseProtectedIdentity for
+// passphrase protected identity files and ParseIdentitiesWithUI for plugins
+// which interact with the user.
+func ParseIdentities(r io.Reader) ([]age.Identity, error) {
+	return ParseIdentitiesWithUI(r, nil)
+}
+
+// ParseIdentitiesWithUI is ParseIdentities, plugin identities
+// (`AGE-PLUGIN-...`) use ui to display messages and prompt the user. The
+// `age-plugin-<name>` binary is run from $PATH when decrypting. ui can be
+// nil, plugin requests then fail.
+func ParseIdentitiesWithUI(r io.Reader, ui *plugin.ClientUI) ([]age.Identity, error) {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if IsSSHPrivateKey(in) {
+		identity, err := ParseSSHIdentity(in, nil)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Identity{identity}, nil
+	}
+	if IsPassphraseProtected(in) {
+		return nil, errors.New("identity file is passphrase protected")
+	}
+
+	var identities []age.Identity
+	scanner := bufio.NewScanner(bytes.NewReader(in))
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var identity age.Identity
+		var err error
+		if strings.HasPrefix(line, "AGE-PLUGIN-") {
+			identity, err = plugin.NewIdentity(line, pluginUI(ui))
+		} else {
+			identity, err = age.ParseX25519Identity(line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed secret key at line %d: %w", n, err)
+		}
+		identities = append(identities, identity)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read secret keys file: %w", err)
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("no secret keys found")
+	}
+	return identities, nil
+}
+
+// IsPassphraseProtected returns true if an identity file is an age file, eg
+// encrypted with `age -p`, rather than a list of identities
+func IsPassphraseProtected(content []byte) bool {
+	return isAge(content) || bytes.HasPrefix(content, []byte("age-encryption.org/"))
+}
+
+// EncryptIdentityFile encrypts an identity file with passphrase, the result
+// is an armored age file which can also be decrypted with `age -d`
+func EncryptIdentityFile(content, passphrase []byte) ([]byte, error) {
+	recipient, err := age.NewScryptRecipient(string(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := Encrypt(bytes.NewReader(content), &out, []age.Recipient{recipient}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// DecryptIdentityFile decrypts an identity file encrypted with passphrase,
+// either armored or not
+func DecryptIdentityFile(content, passphrase []byte) ([]byte, error) {
+	identity, err := age.NewScryptIdentity(string(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = bytes.NewReader(content)
+	if isAge(content) {
+		r = armor.NewReader(r)
+	}
+	dr, err := age.Decrypt(r, identity)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, errors.New("incorrect passphrase")
+	} else if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(dr)
+}
+
+// NewPassphraseProtectedIdentity returns an identity which holds the
+// identities of a passphrase protected identity file. The file is only
+// decrypted when the identity is first used, or when its `Unlock() error`
+// method is called. passphrase is called once and a failure is returned by
+// every Unwrap call.
+func NewPassphraseProtectedIdentity(content []byte, passphrase func() ([]byte, error), ui *plugin.ClientUI) age.Identity {
+	return &passphraseProtectedIdentity{content: content, passphrase: passphrase, ui: ui}
+}
+
+type passphraseProtectedIdentity struct {
+	content    []byte
+	passphrase func() ([]byte, error)
+	ui         *plugin.ClientUI
+
+	once       sync.Once
+	identities []age.Identity
+	err        error
+}
+
+// Unlock decrypts the identity file now instead of on first use, eg to prompt
+// for the passphrase upfront
+func (i *passphraseProtectedIdentity) Unlock() error {
+	i.once.Do(func() {
+		passphrase, err := i.passphrase()
+		if err != nil {
+			i.err = fmt.Errorf("unable to decrypt identity file: %w", err)
+			return
+		}
+		content, err := DecryptIdentityFile(i.content, passphrase)
+		if err != nil {
+			i.err = fmt.Errorf("unable to decrypt identity file: %w", err)
+			return
+		}
+		if i.identities, err = ParseIdentitiesWithUI(bytes.NewReader(content), i.ui); err != nil {
+			i.err = fmt.Errorf("unable to parse decrypted identity file: %w", err)
+		}
+	})
+	return i.err
+}
+
+func (i *passphraseProtectedIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	if err := i.Unlock(); err != nil {
+		return nil, err
+	}
+	for _, identity := range i.identities {
+		fileKey, err := identity.Unwrap(stanzas)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			continue
+		}
+		return fileKey, err
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// pluginUI returns ui, or a UI which fails all plugin requests if it's nil
+func pluginUI(ui *plugin.ClientUI) *plugin.ClientUI {
+	if ui == nil {
+		return &plugin.ClientUI{}
+	}
+	return ui
+}
+
+// isPluginRecipient returns true for age plugin recipients, `age1<name>1...`,
+// X25519 recipients have no name
+func isPluginRecipient(s string) bool {
+	return strings.HasPrefix(s, "age1") && strings.LastIndex(s, "1") > len("age")
+}
+
+// IsSSHPrivateKey returns true if content is a PEM encoded (SSH) private key
+func IsSSHPrivateKey(content []byte) bool {
+	content = bytes.TrimSpace(content)
+	return bytes.HasPrefix(content, []byte("-----BEGIN")) && !isAge(content)
+}
+
+// ParseSSHIdentity parses an ed25519 or RSA SSH private key. passphrase is
+// only called for passphrase protected keys, when decrypting a file which is
+// encrypted for the key, it can be nil if the key isn't protected.
+func ParseSSHIdentity(pemBytes []byte, passphrase func() ([]byte, error)) (age.Identity, error) {
+	identity, err := agessh.ParseIdentity(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return identity, err
+	}
+	if passphrase == nil {
+		return nil, errors.New("SSH key is passphrase protected")
+	}
+	if missing.PublicKey == nil {
+		// only OpenSSH keys hold the public key unencrypted
+		return nil, errors.New("passphrase protected SSH key must be in OpenSSH format")
+	}
+	return agessh.NewEncryptedSSHIdentity(missing.PublicKey, pemBytes, passphrase)
+}
+
+// Encrypt encrypts plaintext read from r for recipients and writes it to w
+// as an armored age file
+func Encrypt(r io.Reader, w io.Writer, recipients []age.Recipient) error {
+	armorWriter := armor.NewWriter(w)
+	wc, err := age.Encrypt(armorWriter, recipients...)
+	if err != nil {
+		return fmt.Errorf("failed to create encrypted file: %w", err)
+	}
+	if _, err := io.Copy(wc, r); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("failed to close encrypted file: %w", err)
+	}
+	if err := armorWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close armor: %w", err)
+	}
+	return nil
+}
+
+func isAge(in []byte) bool {
+	return strings.HasPrefix(string(in), armor.Header)
+}
+
+func ageEncrypt(w io.Writer, r []age.Recipient, in []byte, f string, opts Options) error {
+	// We have to do check the following because age's encryption is non
+	// deterministic
+	//
+	// if there's no difference between the decrypted version of the file
+	// at HEAD and the new contents AND file's recipient hasn't changed, do
+	// not re-encrypt
+	if opts.Reencrypt {
+		return Encrypt(bytes.NewReader(in), w, r)
+	}
+	fah, equal, err := agePlaintextEqual(in, f, opts)
+	if err != nil {
+		return err
+	}
+	if equal {
+		changed, err := ageRecipientChanged(f, opts)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			_, err := io.Copy(w, bytes.NewReader(fah))
+			return err
+		}
+	}
+
+	return Encrypt(bytes.NewReader(in), w, r)
+}
+
+func ageDecrypt(in []byte, identities []age.Identity) ([]byte, error) {
+	if len(identities) == 0 {
+		return nil, ErrNoIdentities
+	}
+	ar, err := age.Decrypt(armor.NewReader(bytes.NewReader(in)), identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(ar)
+}
+
+// ageIdentities returns the identities to decrypt in, the content of
+// filename, with. Files encrypted with PassphraseDirective can only be
+// decrypted with the passphrase, if Options.Passphrase is set, and the shares
+// of files encrypted with ThresholdDirective are combined.
+func ageIdentities(in []byte, filename string, opts Options) []age.Identity {
+	switch {
+	case opts.Passphrase != nil && isPassphraseEncrypted(in):
+		return []age.Identity{passphraseIdentity{filename: filename, opts: opts}}
+	case len(opts.Identities) > 0 && isThresholdEncrypted(in):
+		return []age.Identity{NewThresholdIdentity(opts.Identities)}
+	}
+	return opts.Identities
+}
+
+// ageHeaderContains returns true if the header of in, an armored age file,
+// has a stanza of stanzaType
+func ageHeaderContains(in []byte, stanzaType string) bool {
+	header, _ := io.ReadAll(io.LimitReader(armor.NewReader(bytes.NewReader(in)), 512))
+	return bytes.Contains(header, []byte("\n-> "+stanzaType+" "))
+}
+
+// noIdentity matches no recipient, decrypting with it only parses the header
+type noIdentity struct{}
+
+func (noIdentity) Unwrap([]*age.Stanza) ([]byte, error) {
+	return nil, age.ErrIncorrectIdentity
+}
+
+func ageCheckFraming(in []byte) error {
+	if _, err := io.Copy(io.Discard, armor.NewReader(bytes.NewReader(in))); err != nil {
+		return fmt.Errorf("invalid age armor: %w", err)
+	}
+	_, err := age.Decrypt(armor.NewReader(bytes.NewReader(in)), noIdentity{})
+	var noMatch *age.NoIdentityMatchError
+	if err != nil && !errors.As(err, &noMatch) {
+		return fmt.Errorf("invalid age header: %w", err)
+	}
+	return nil
+}
+
+// agePlaintextEqual returns the file at HEAD and whether its plaintext is
+// equal to in
+func agePlaintextEqual(in []byte, f string, opts Options) ([]byte, bool, error) {
+	// if the file doesn't exist at HEAD, it's new, meaning we need to encrypt
+	// it for the first time
+	fileAtHEAD, ok, err := opts.Repository.ReadFileAtHEAD(f)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	// potentially re-encrypting SIV file
+	if !isAge(fileAtHEAD) {
+		return fileAtHEAD, false, nil
+	}
+	plaintext, err := ageDecrypt(fileAtHEAD, ageIdentities(fileAtHEAD, f, opts))
+	if err != nil {
+		// we can't tell if the plaintext changed, re-encrypt
+		return fileAtHEAD, false, nil
+	}
+	return fileAtHEAD, bytes.Equal(plaintext, in), nil
+}
+
+// ageRecipientChanged returns true if the recipients of filename differ from
+// HEAD, files referenced by directives are compared too
+func ageRecipientChanged(filename string, opts Options) (bool, error) {
+	path, recipients, err := FindRecipients(filename, opts)
+	if err != nil || path == "" {
+		return false, err
+	}
+	headOpts := opts
+	headOpts.Repository = headRepository{opts.Repository}
+	headPath, headRecipients, err := FindRecipients(filename, headOpts)
+	if err != nil || headPath == "" {
+		// can't tell what it was encrypted for, re-encrypt
+		return true, nil
+	}
+	return !slices.Equal(recipientKeys(recipients), recipientKeys(headRecipients)), nil
+}
@@ -0,0 +1,112 @@
+package strongbox
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHRecipientsAndIdentities(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	x25519, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	authorizedKey := func(key any) string {
+		signer, err := ssh.NewSignerFromKey(key)
+		require.NoError(t, err)
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	}
+	recipients, err := ParseRecipients(strings.NewReader(strings.Join([]string{
+		"# ed25519 key of alice",
+		authorizedKey(edKey) + " alice@example.com",
+		`from="10.0.0.0/8" ` + authorizedKey(rsaKey),
+		"",
+		x25519.Recipient().String(),
+	}, "\n")))
+	require.NoError(t, err)
+	require.Len(t, recipients, 3)
+
+	_, err = ParseRecipients(strings.NewReader("ssh-ed25519 AAAAnotakey\n"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 1")
+	_, err = ParseRecipients(strings.NewReader("# nobody\n"))
+	require.Error(t, err)
+
+	var enc bytes.Buffer
+	require.NoError(t, Encrypt(strings.NewReader("secret"), &enc, recipients))
+
+	decrypt := func(identity age.Identity) string {
+		t.Helper()
+		var out bytes.Buffer
+		require.NoError(t, Decrypt(bytes.NewReader(enc.Bytes()), &out, []age.Identity{identity}, nil))
+		return out.String()
+	}
+	for _, key := range []any{edKey, rsaKey} {
+		block, err := ssh.MarshalPrivateKey(key, "")
+		require.NoError(t, err)
+		identities, err := ParseIdentities(bytes.NewReader(pem.EncodeToMemory(block)))
+		require.NoError(t, err)
+		require.Equal(t, "secret", decrypt(identities[0]))
+	}
+
+	// passphrase protected
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(edKey, "", []byte("hunter2"))
+	require.NoError(t, err)
+	protected := pem.EncodeToMemory(block)
+	_, err = ParseIdentities(bytes.NewReader(protected))
+	require.Error(t, err)
+	var prompted int
+	identity, err := ParseSSHIdentity(protected, func() ([]byte, error) {
+		prompted++
+		return []byte("hunter2"), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 0, prompted, "passphrase should only be asked for when needed")
+	require.Equal(t, "secret", decrypt(identity))
+	require.Equal(t, 1, prompted)
+}
+
+func TestPassphraseProtectedIdentity(t *testing.T) {
+	x25519, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	var enc1, enc2 bytes.Buffer
+	require.NoError(t, Encrypt(strings.NewReader("secret1"), &enc1, []age.Recipient{x25519.Recipient()}))
+	require.NoError(t, Encrypt(strings.NewReader("secret2"), &enc2, []age.Recipient{x25519.Recipient()}))
+
+	identityFile := "# description: test\n" + x25519.String() + "\n"
+	protected, err := EncryptIdentityFile([]byte(identityFile), []byte("hunter2"))
+	require.NoError(t, err)
+	require.True(t, IsPassphraseProtected(protected))
+	require.False(t, IsPassphraseProtected([]byte(identityFile)))
+	require.NotContains(t, string(protected), x25519.String())
+	_, err = ParseIdentities(bytes.NewReader(protected))
+	require.Error(t, err)
+
+	var prompted int
+	identity := NewPassphraseProtectedIdentity(protected, func() ([]byte, error) {
+		prompted++
+		return []byte("hunter2"), nil
+	}, nil)
+	require.Equal(t, 0, prompted, "passphrase should only be asked for when needed")
+	for _, tc := range []struct{ enc, plaintext string }{{enc1.String(), "secret1"}, {enc2.String(), "secret2"}} {
+		var out bytes.Buffer
+		require.NoError(t, Decrypt(strings.NewReader(tc.enc), &out, []age.Identity{identity}, nil))
+		require.Equal(t, tc.plaintext, out.String())
+	}
+	require.Equal(t, 1, prompted)
+
+	_, err = DecryptIdentityFile(protected, []byte("hunter3"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "incorrect passphrase")
+}
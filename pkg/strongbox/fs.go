@@ -0,0 +1,206 @@
+package strongbox
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// FS wraps a fs.FS and transparently decrypts strongbox files, eg to read
+// encrypted config from an embed.FS or a checkout of a repository at runtime.
+// Files which aren't encrypted are returned as is.
+type FS struct {
+	fsys       fs.FS
+	identities []age.Identity
+	keyRing    KeyRing
+}
+
+var (
+	_ fs.ReadFileFS = (*FS)(nil)
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+)
+
+// NewFS returns a FS which decrypts age files of fsys with identities and siv
+// files with the key of their closest `.strongbox-keyid` in fsys. If there is
+// no key-id file all keys of keyRing are tried.
+func NewFS(fsys fs.FS, identities []age.Identity, keyRing KeyRing) *FS {
+	return &FS{fsys: fsys, identities: identities, keyRing: keyRing}
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &dir{File: file, fsys: f, name: name}, nil
+	}
+
+	// only read the whole file if it's encrypted
+	chunk := make([]byte, max(len(Prefix), len(armor.Header)))
+	n, err := io.ReadFull(file, chunk)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+	if !IsEncrypted(chunk[:n]) {
+		file.Close()
+		return f.fsys.Open(name)
+	}
+
+	rest, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	out, err := f.decrypt(name, append(chunk[:n], rest...))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &decryptedFile{
+		Reader: bytes.NewReader(out),
+		info:   decryptedFileInfo{FileInfo: fi, size: int64(len(out))},
+	}, nil
+}
+
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	in, err := fs.ReadFile(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if !IsEncrypted(in) {
+		return in, nil
+	}
+	out, err := f.decrypt(name, in)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return out, nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return f.wrapEntries(name, entries), nil
+}
+
+// Stat returns the size of the decrypted content for encrypted files
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+func (f *FS) decrypt(name string, in []byte) ([]byte, error) {
+	keyRing := f.keyRing
+	if bytes.HasPrefix(in, Prefix) && keyRing != nil {
+		if keyID, err := FindKeyID(fsRepository{f.fsys}, name); err == nil {
+			key, err := keyRing.Key(keyID)
+			if err != nil {
+				return nil, err
+			}
+			keyRing = StaticKeyRing{key}
+		}
+	}
+	var out bytes.Buffer
+	if err := Decrypt(bytes.NewReader(in), &out, f.identities, keyRing); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (f *FS) wrapEntries(dirName string, entries []fs.DirEntry) []fs.DirEntry {
+	wrapped := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		wrapped[i] = dirEntry{DirEntry: e, fsys: f, name: path.Join(dirName, e.Name())}
+	}
+	return wrapped
+}
+
+// fsRepository is a Repository of files in a fs.FS, there is no HEAD
+type fsRepository struct {
+	fsys fs.FS
+}
+
+func (r fsRepository) ReadFile(name string) ([]byte, bool, error) {
+	content, err := fs.ReadFile(r.fsys, filepath.ToSlash(name))
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return content, true, nil
+}
+
+func (r fsRepository) ReadFileAtHEAD(name string) ([]byte, bool, error) {
+	return nil, false, nil
+}
+
+type decryptedFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *decryptedFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *decryptedFile) Close() error {
+	return nil
+}
+
+type decryptedFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (fi decryptedFileInfo) Size() int64 {
+	return fi.size
+}
+
+// dir wraps directories so entries report the size of decrypted content
+type dir struct {
+	fs.File
+	fsys *FS
+	name string
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rd, ok := d.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: errors.New("not implemented")}
+	}
+	entries, err := rd.ReadDir(n)
+	return d.fsys.wrapEntries(d.name, entries), err
+}
+
+type dirEntry struct {
+	fs.DirEntry
+	fsys *FS
+	name string
+}
+
+func (e dirEntry) Info() (fs.FileInfo, error) {
+	if e.IsDir() {
+		return e.DirEntry.Info()
+	}
+	return e.fsys.Stat(e.name)
+}
@@ -0,0 +1,53 @@
+package strongbox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	require.NoError(t, err)
+	keyID := sha256.Sum256(key)
+
+	var ageEnc, sivEnc bytes.Buffer
+	require.NoError(t, Encrypt(strings.NewReader("age-secret"), &ageEnc, []age.Recipient{identity.Recipient()}))
+	require.NoError(t, EncryptSIV(strings.NewReader("siv-secret"), &sivEnc, key))
+
+	fsys := NewFS(fstest.MapFS{
+		"config/age.yaml":             {Data: ageEnc.Bytes()},
+		"config/siv/" + KeyIDFilename: {Data: encode(keyID[:])},
+		"config/siv/secret.yaml":      {Data: sivEnc.Bytes()},
+		"config/plain.yaml":           {Data: []byte("plain")},
+	}, []age.Identity{identity}, StaticKeyRing{key})
+
+	for name, expected := range map[string]string{
+		"config/age.yaml":        "age-secret",
+		"config/siv/secret.yaml": "siv-secret",
+		"config/plain.yaml":      "plain",
+	} {
+		content, err := fs.ReadFile(fsys, name)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(content))
+	}
+
+	require.NoError(t, fstest.TestFS(fsys, "config/age.yaml", "config/siv/secret.yaml", "config/plain.yaml"))
+
+	// without the identity the file can't be read
+	noIdentities := NewFS(fstest.MapFS{"age.yaml": {Data: ageEnc.Bytes()}}, nil, nil)
+	_, err = fs.ReadFile(noIdentities, "age.yaml")
+	require.ErrorIs(t, err, ErrNoIdentities)
+	_, err = noIdentities.Open("age.yaml")
+	require.ErrorIs(t, err, ErrNoIdentities)
+}
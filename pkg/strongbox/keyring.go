@@ -0,0 +1,136 @@
+package strongbox
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ErrKeyNotFound is returned when a KeyRing doesn't hold the requested key
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeyRing holds siv keys
+type KeyRing interface {
+	// Key returns the key with keyID or ErrKeyNotFound
+	Key(keyID []byte) ([]byte, error)
+	// Keys returns all keys of the keyring
+	Keys() ([][]byte, error)
+}
+
+// SIVDecrypter is implemented by key rings which decrypt siv content without
+// giving out their keys, eg held by an agent. It's used instead of
+// KeyRing.Keys when the key-id of the content isn't known.
+type SIVDecrypter interface {
+	// DecryptSIV returns the plaintext of enc or ErrKeyNotFound
+	DecryptSIV(enc []byte) ([]byte, error)
+}
+
+// FileKeyRing is a KeyRing stored in a yaml file, eg `$HOME/.strongbox_keyring`
+type FileKeyRing struct {
+	fileName   string
+	KeyEntries []KeyEntry
+}
+
+type KeyEntry struct {
+	Description string `yaml:"description"`
+	KeyID       string `yaml:"key-id"`
+	Key         string `yaml:"key"`
+}
+
+// NewFileKeyRing returns an empty keyring stored in fileName, call Load to
+// read existing keys
+func NewFileKeyRing(fileName string) *FileKeyRing {
+	return &FileKeyRing{fileName: fileName}
+}
+
+func (kr *FileKeyRing) AddKey(desc string, keyID []byte, key []byte) {
+	kr.KeyEntries = append(kr.KeyEntries, KeyEntry{
+		Description: desc,
+		KeyID:       string(encode(keyID[:])),
+		Key:         string(encode(key[:])),
+	})
+}
+
+func (kr *FileKeyRing) Key(keyID []byte) ([]byte, error) {
+	b64 := string(encode(keyID[:]))
+
+	for _, ke := range kr.KeyEntries {
+		if ke.KeyID == b64 {
+			dec, err := decode([]byte(ke.Key))
+			if err != nil {
+				return []byte{}, err
+			}
+			if len(dec) != 32 {
+				return []byte{}, fmt.Errorf("unexpected length of key: %d", len(dec))
+			}
+			return dec, nil
+		}
+	}
+
+	return []byte{}, ErrKeyNotFound
+}
+
+// Keys returns all valid keys in the keyring
+func (kr *FileKeyRing) Keys() ([][]byte, error) {
+	var keys [][]byte
+	for _, ke := range kr.KeyEntries {
+		dec, err := decode([]byte(ke.Key))
+		if err != nil || len(dec) != 32 {
+			continue
+		}
+		keys = append(keys, dec)
+	}
+	return keys, nil
+}
+
+func (kr *FileKeyRing) Load() error {
+
+	bytes, err := os.ReadFile(kr.fileName)
+	if err != nil {
+		return err
+	}
+
+	err = yaml.Unmarshal(bytes, kr)
+	return err
+}
+
+func (kr *FileKeyRing) Save() error {
+	ser, err := yaml.Marshal(kr)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Dir(kr.fileName)
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		err := os.MkdirAll(path, 0700)
+		if err != nil {
+			return fmt.Errorf("error creating strongbox home folder: %s", err)
+		}
+	}
+
+	return os.WriteFile(kr.fileName, ser, 0600)
+}
+
+// StaticKeyRing is a KeyRing of keys held in memory, key-ids are derived
+// from the keys
+type StaticKeyRing [][]byte
+
+func (s StaticKeyRing) Key(keyID []byte) ([]byte, error) {
+	for _, key := range s {
+		id := sha256.Sum256(key)
+		if bytes.Equal(id[:], keyID) {
+			return key, nil
+		}
+	}
+	return []byte{}, ErrKeyNotFound
+}
+
+func (s StaticKeyRing) Keys() ([][]byte, error) {
+	return s, nil
+}
@@ -0,0 +1,125 @@
+package strongbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// PassphraseDirective in a recipient file encrypts files with a passphrase
+// shared by everyone instead of keys, `@passphrase [name]`. The passphrase is
+// asked for with Options.Passphrase, name tells passphrases of different
+// directories apart. It can't be combined with other recipients.
+const PassphraseDirective = "@passphrase"
+
+// passphraseRecipient is the recipient of PassphraseDirective, the passphrase
+// is only asked for when a file is encrypted
+type passphraseRecipient struct {
+	name string
+	opts Options
+}
+
+func newPassphraseRecipient(name string, opts Options) (Recipient, error) {
+	if opts.Passphrase == nil {
+		return Recipient{}, errors.New("no passphrase source given")
+	}
+	key := strings.TrimSpace(PassphraseDirective + " " + name)
+	return Recipient{Recipient: passphraseRecipient{name: name, opts: opts}, Key: key}, nil
+}
+
+func (r passphraseRecipient) scryptRecipient() (*age.ScryptRecipient, error) {
+	passphrase, err := r.opts.Passphrase(r.name)
+	if err != nil {
+		return nil, err
+	}
+	return age.NewScryptRecipient(string(passphrase))
+}
+
+func (r passphraseRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	stanzas, _, err := r.WrapWithLabels(fileKey)
+	return stanzas, err
+}
+
+// WrapWithLabels keeps the label of age.ScryptRecipient, it ensures the
+// passphrase is the only recipient of a file
+func (r passphraseRecipient) WrapWithLabels(fileKey []byte) ([]*age.Stanza, []string, error) {
+	recipient, err := r.scryptRecipient()
+	if err != nil {
+		return nil, nil, err
+	}
+	return recipient.WrapWithLabels(fileKey)
+}
+
+// passphraseIdentity decrypts files encrypted with PassphraseDirective, the
+// passphrase is only asked for when a file encrypted with one is decrypted
+type passphraseIdentity struct {
+	filename string
+	opts     Options
+}
+
+func (i passphraseIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	name, err := passphraseName(i.filename, i.opts)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := i.opts.Passphrase(name)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := age.NewScryptIdentity(string(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := identity.Unwrap(stanzas)
+	if errors.Is(err, age.ErrIncorrectIdentity) {
+		return nil, fmt.Errorf("incorrect passphrase %q", name)
+	}
+	return fileKey, err
+}
+
+// isPassphraseEncrypted returns true if in is an armored age file encrypted
+// with a passphrase
+func isPassphraseEncrypted(in []byte) bool {
+	return ageHeaderContains(in, "scrypt")
+}
+
+// passphraseName returns the name given to PassphraseDirective by the closest
+// recipient files of filename, or those they inherit, empty if there is none
+func passphraseName(filename string, opts Options) (string, error) {
+	for {
+		path, content, err := findRepoFile(opts.Repository, filename, RecipientFilename, RecipientDirname)
+		if err != nil || path == "" {
+			return "", err
+		}
+		files, err := readRecipientFiles(opts.Repository, path, content)
+		if err != nil {
+			return "", err
+		}
+		inherit := false
+		for _, file := range files {
+			scanner := bufio.NewScanner(bytes.NewReader(file.content))
+			for scanner.Scan() {
+				directive, arg, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+				switch directive {
+				case PassphraseDirective:
+					return strings.TrimSpace(arg), nil
+				case InheritDirective:
+					inherit = true
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				return "", err
+			}
+		}
+		// the parent directory is searched next
+		filename = filepath.Dir(path)
+		if !inherit || filename == "." {
+			return "", nil
+		}
+	}
+}
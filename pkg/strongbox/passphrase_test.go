@@ -0,0 +1,73 @@
+package strongbox
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox/strongboxtest"
+)
+
+func TestPassphraseRecipient(t *testing.T) {
+	repo := strongboxtest.MemRepository{
+		WorkTree: map[string]string{
+			"secrets/" + RecipientFilename: "# shared by the team\n" + PassphraseDirective + " team\n",
+		},
+		Head: map[string]string{},
+	}
+	var asked []string
+	passphrase := "hunter2"
+	opts := Options{
+		Repository: repo,
+		Passphrase: func(name string) ([]byte, error) {
+			asked = append(asked, name)
+			return []byte(passphrase), nil
+		},
+	}
+
+	_, recipients, err := FindRecipients("secrets/secret", opts)
+	require.NoError(t, err)
+	require.Equal(t, []string{PassphraseDirective + " team"}, recipientKeys(recipients))
+	require.Empty(t, asked, "passphrase should only be asked for when encrypting")
+
+	plaintext := "t0ps3cret\n"
+	encrypted := clean(t, plaintext, "secrets/secret", opts)
+	require.True(t, isPassphraseEncrypted([]byte(encrypted)))
+	require.Equal(t, []string{"team"}, asked)
+	require.Equal(t, plaintext, smudge(t, encrypted, "secrets/secret", opts))
+
+	// unchanged files aren't re-encrypted
+	repo.Head["secrets/secret"] = encrypted
+	repo.Head["secrets/"+RecipientFilename] = repo.WorkTree["secrets/"+RecipientFilename]
+	require.Equal(t, encrypted, clean(t, plaintext, "secrets/secret", opts))
+
+	// other identities can't decrypt it
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	var out bytes.Buffer
+	require.Error(t, Decrypt(strings.NewReader(encrypted), &out, []age.Identity{identity}, nil))
+
+	passphrase = "hunter3"
+	var reason error
+	opts.LeftEncrypted = func(filename string, err error) error {
+		reason = err
+		return nil
+	}
+	require.Equal(t, encrypted, smudge(t, encrypted, "secrets/secret", opts))
+	require.Error(t, reason)
+	require.Contains(t, reason.Error(), `incorrect passphrase "team"`)
+
+	repo.WorkTree["secrets/"+RecipientFilename] += identity.Recipient().String() + "\n"
+	_, _, err = FindRecipients("secrets/secret", opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "can't be combined")
+
+	repo.WorkTree["secrets/"+RecipientFilename] = PassphraseDirective + "\n"
+	opts.Passphrase = func(string) ([]byte, error) { return nil, errors.New("no terminal") }
+	err = Clean(strings.NewReader(plaintext), &out, "secrets/new", opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no terminal")
+}
@@ -0,0 +1,185 @@
+package strongbox
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age/plugin"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox/strongboxtest"
+)
+
+// testPluginName is the name of the fake plugin implemented by the test
+// binary, see fakePlugin
+const testPluginName = "strongboxtest"
+
+func TestMain(m *testing.M) {
+	if filepath.Base(os.Args[0]) == "age-plugin-"+testPluginName {
+		os.Exit(fakePlugin(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// stanza is an age plugin protocol stanza
+type stanza struct {
+	args []string
+	body []byte
+}
+
+func readStanza(r *bufio.Reader) (stanza, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return stanza{}, err
+	}
+	s := stanza{args: strings.Fields(strings.TrimPrefix(line, "-> "))}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return stanza{}, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		chunk, err := base64.RawStdEncoding.DecodeString(line)
+		if err != nil {
+			return stanza{}, err
+		}
+		s.body = append(s.body, chunk...)
+		if len(line) < 64 {
+			return s, nil
+		}
+	}
+}
+
+func writeStanza(args []string, body []byte) {
+	fmt.Printf("-> %s\n%s\n", strings.Join(args, " "), base64.RawStdEncoding.EncodeToString(body))
+}
+
+// fakePlugin is a plugin which "wraps" file keys by storing them as is in
+// `strongboxtest` stanzas. The identity tells the user about every file key
+// it unwraps.
+func fakePlugin(args []string) int {
+	r := bufio.NewReader(os.Stdin)
+	var fileKeys [][]byte
+	for {
+		s, err := readStanza(r)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if s.args[0] == "done" {
+			break
+		}
+		switch {
+		case s.args[0] == "wrap-file-key":
+			fileKeys = append(fileKeys, s.body)
+		case s.args[0] == "recipient-stanza" && s.args[2] == testPluginName:
+			fileKeys = append(fileKeys, s.body)
+		}
+	}
+
+	// every stanza but done is acknowledged by the client
+	var replies []stanza
+	switch args[0] {
+	case "--age-plugin=recipient-v1":
+		replies = []stanza{{args: []string{"recipient-stanza", "0", testPluginName}, body: fileKeys[0]}}
+	case "--age-plugin=identity-v1":
+		if len(fileKeys) > 0 {
+			replies = []stanza{
+				{args: []string{"msg"}, body: []byte("unwrapping file key")},
+				{args: []string{"file-key", "0"}, body: fileKeys[0]},
+			}
+		}
+	default:
+		return 1
+	}
+	for _, reply := range replies {
+		writeStanza(reply.args, reply.body)
+		if _, err := readStanza(r); err != nil {
+			return 1
+		}
+	}
+	writeStanza([]string{"done"}, nil)
+	return 0
+}
+
+// installFakePlugin links the test binary as `age-plugin-strongboxtest` in a
+// directory added to $PATH
+func installFakePlugin(t *testing.T) {
+	t.Helper()
+	bin, err := os.Executable()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	require.NoError(t, os.Symlink(bin, filepath.Join(dir, "age-plugin-"+testPluginName)))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestPlugin(t *testing.T) {
+	installFakePlugin(t)
+
+	recipient := plugin.EncodeRecipient(testPluginName, []byte("recipient"))
+	var messages []string
+	ui := &plugin.ClientUI{
+		DisplayMessage: func(name, message string) error {
+			messages = append(messages, name+": "+message)
+			return nil
+		},
+	}
+	identities, err := ParseIdentitiesWithUI(strings.NewReader(
+		"# fake plugin identity\n"+plugin.EncodeIdentity(testPluginName, []byte("identity"))+"\n",
+	), ui)
+	require.NoError(t, err)
+	require.Len(t, identities, 1)
+
+	repo := strongboxtest.MemRepository{
+		WorkTree: map[string]string{RecipientFilename: recipient + "\n"},
+		Head:     map[string]string{},
+	}
+	opts := Options{Identities: identities, Repository: repo, PluginUI: ui}
+
+	plaintext := "t0ps3cret\n"
+	encrypted := clean(t, plaintext, "secret", opts)
+	require.True(t, IsEncrypted([]byte(encrypted)))
+	require.Contains(t, ageStanzaTypes(t, encrypted), testPluginName)
+	require.Empty(t, messages)
+
+	require.Equal(t, plaintext, smudge(t, encrypted, "secret", opts))
+	require.Equal(t, []string{testPluginName + ": unwrapping file key"}, messages)
+
+	recipients, err := ParseRecipients(strings.NewReader(recipient + "\n"))
+	require.NoError(t, err)
+	require.IsType(t, &plugin.Recipient{}, recipients[0])
+
+	t.Run("missing plugin", func(t *testing.T) {
+		missing := plugin.EncodeRecipient("strongboxmissing", nil)
+		repo.WorkTree[RecipientFilename] = missing + "\n"
+		err := Clean(strings.NewReader(plaintext), &strings.Builder{}, "secret", opts)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "strongboxmissing plugin")
+	})
+}
+
+// ageStanzaTypes returns the type of the recipient stanzas of an armored age
+// file
+func ageStanzaTypes(t *testing.T, encrypted string) []string {
+	t.Helper()
+	var header strings.Builder
+	for _, line := range strings.Split(encrypted, "\n")[1:] {
+		if strings.HasPrefix(line, "-----") {
+			break
+		}
+		header.WriteString(line)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header.String())
+	require.NoError(t, err)
+	var types []string
+	for _, line := range strings.Split(string(decoded), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "->" {
+			types = append(types, fields[1])
+		}
+	}
+	return types
+}
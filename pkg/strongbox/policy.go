@@ -0,0 +1,139 @@
+package strongbox
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// PolicyFilename is the policy of a repository, at its root. Clean refuses to
+// encrypt files whose recipients violate it.
+const PolicyFilename = ".strongbox-policy.yaml"
+
+// Backends a file can be encrypted with, see Policy.AllowedBackends. Files of
+// BackendNone are left unencrypted by NoneDirective.
+const (
+	BackendAge  = "age"
+	BackendSIV  = "siv"
+	BackendNone = "none"
+)
+
+var (
+	// ErrPolicyViolation is wrapped by the errors of Policy.Check
+	ErrPolicyViolation = errors.New("policy violation")
+	// ErrInvalidPolicy is wrapped by FindPolicy if the policy can't be parsed
+	ErrInvalidPolicy = errors.New("invalid policy")
+)
+
+// Policy constrains the recipients of the files of a repository:
+//
+//	required_recipients:
+//	  - age1breakglass...
+//	revoked_keys:
+//	  - ssh-ed25519 AAAA...
+//	min_recipients: 2
+//	allowed_backends: [age]
+//
+// The recipient rules only apply to age files, AllowedBackends to every file.
+type Policy struct {
+	// RequiredRecipients must be recipients of every age file, members of a
+	// threshold don't count as they can't decrypt alone
+	RequiredRecipients []string `yaml:"required_recipients"`
+	// RevokedKeys can't be recipients, including members of a threshold
+	RevokedKeys []string `yaml:"revoked_keys"`
+	// MinRecipients is the minimum number of recipients of age files, a
+	// threshold counts as one
+	MinRecipients int `yaml:"min_recipients"`
+	// AllowedBackends, if set, are the backends files can use
+	AllowedBackends []string `yaml:"allowed_backends"`
+}
+
+// ParsePolicy parses a policy file, unknown fields are an error so typos
+// don't silently weaken the policy
+func ParsePolicy(content []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.UnmarshalStrict(content, &p); err != nil {
+		return nil, err
+	}
+	if p.MinRecipients < 0 {
+		return nil, fmt.Errorf("invalid min_recipients %d", p.MinRecipients)
+	}
+	for _, backend := range p.AllowedBackends {
+		if backend != BackendAge && backend != BackendSIV && backend != BackendNone {
+			return nil, fmt.Errorf("unknown backend %q in allowed_backends", backend)
+		}
+	}
+	// keys are compared without SSH comments
+	for _, keys := range []*[]string{&p.RequiredRecipients, &p.RevokedKeys} {
+		for i, key := range *keys {
+			recipient, err := parseRecipient(strings.TrimSpace(key), nil)
+			if err != nil {
+				return nil, fmt.Errorf("malformed key %q: %w", key, err)
+			}
+			(*keys)[i] = recipient.Key
+		}
+	}
+	return &p, nil
+}
+
+// FindPolicy returns the policy of repo, nil if it has none
+func FindPolicy(repo Repository) (*Policy, error) {
+	content, ok, err := repo.ReadFile(PolicyFilename)
+	if err != nil || !ok {
+		return nil, err
+	}
+	policy, err := ParsePolicy(content)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrInvalidPolicy, PolicyFilename, err)
+	}
+	return policy, nil
+}
+
+// Check returns an error listing the violations of the policy by a file of
+// backend encrypted for recipients. A nil policy allows everything.
+func (p *Policy) Check(backend string, recipients []Recipient) error {
+	if p == nil {
+		return nil
+	}
+	var violations []string
+	if len(p.AllowedBackends) > 0 && !slices.Contains(p.AllowedBackends, backend) {
+		violations = append(violations, fmt.Sprintf("the %s backend isn't allowed", backend))
+	}
+	if backend != BackendAge {
+		return policyError(violations)
+	}
+
+	direct := make(map[string]bool)
+	var all []Recipient
+	for _, r := range recipients {
+		direct[r.Key] = true
+		all = append(all, r)
+		if t, ok := r.Recipient.(thresholdRecipient); ok {
+			all = append(all, t.recipients...)
+		}
+	}
+	for _, key := range p.RequiredRecipients {
+		if !direct[key] {
+			violations = append(violations, fmt.Sprintf("required recipient %s is missing", key))
+		}
+	}
+	for _, r := range all {
+		if slices.Contains(p.RevokedKeys, r.Key) {
+			violations = append(violations, fmt.Sprintf("revoked key of %s is a recipient", r))
+		}
+	}
+	if len(direct) < p.MinRecipients {
+		violations = append(violations, fmt.Sprintf("%d recipient(s), at least %d are required", len(direct), p.MinRecipients))
+	}
+	return policyError(violations)
+}
+
+func policyError(violations []string) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrPolicyViolation, strings.Join(violations, ", "))
+}
@@ -0,0 +1,100 @@
+package strongbox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox/strongboxtest"
+)
+
+func TestParsePolicy(t *testing.T) {
+	_, breakGlass := newSSHKey(t)
+	policy, err := ParsePolicy([]byte("required_recipients:\n  - " + breakGlass + " break-glass\nmin_recipients: 2\nallowed_backends: [age, none]\n"))
+	require.NoError(t, err)
+	require.Equal(t, &Policy{
+		RequiredRecipients: []string{breakGlass},
+		MinRecipients:      2,
+		AllowedBackends:    []string{BackendAge, BackendNone},
+	}, policy)
+
+	for _, content := range []string{
+		"required_recipient: [age1...]\n",
+		"revoked_keys: [age1nope]\n",
+		"min_recipients: -1\n",
+		"allowed_backends: [gpg]\n",
+	} {
+		_, err := ParsePolicy([]byte(content))
+		require.Error(t, err, content)
+	}
+}
+
+func TestCleanPolicy(t *testing.T) {
+	alice, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	breakGlass, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	revoked, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	require.NoError(t, err)
+	keyID := sha256.Sum256(key)
+	repo := strongboxtest.MemRepository{
+		WorkTree: map[string]string{
+			PolicyFilename: "required_recipients: [" + breakGlass.Recipient().String() + "]\n" +
+				"revoked_keys: [" + revoked.Recipient().String() + "]\n" +
+				"allowed_backends: [age]\n",
+			"ok/" + RecipientFilename:                      alice.Recipient().String() + "\n" + breakGlass.Recipient().String() + "\n",
+			"missing/" + RecipientFilename:                 "# name: alice\n" + alice.Recipient().String() + "\n",
+			"revoked/" + RecipientDirname + "/old.pub":     revoked.Recipient().String() + "\n",
+			"revoked/" + RecipientDirname + "/break-glass": breakGlass.Recipient().String() + "\n",
+			"threshold/" + RecipientFilename:               ThresholdDirective + " 1\n" + breakGlass.Recipient().String() + "\n" + revoked.Recipient().String() + "\n",
+			"siv/" + KeyIDFilename:                         string(encode(keyID[:])),
+			"public/" + RecipientFilename:                  NoneDirective + "\n",
+		},
+		Head: map[string]string{},
+	}
+	opts := Options{Repository: repo, Identities: []age.Identity{breakGlass}, KeyRing: StaticKeyRing{key}}
+	encrypted := clean(t, "secret", "ok/secret", opts)
+	require.Equal(t, "secret", smudge(t, encrypted, "ok/secret", opts))
+
+	for file, violation := range map[string]string{
+		"missing/secret":   "required recipient " + breakGlass.Recipient().String() + " is missing",
+		"revoked/secret":   "revoked key of old is a recipient",
+		"threshold/secret": "revoked key of " + revoked.Recipient().String() + " is a recipient",
+		"siv/secret":       "the siv backend isn't allowed",
+		"public/secret":    "the none backend isn't allowed",
+	} {
+		err := Clean(bytes.NewReader([]byte("secret")), &bytes.Buffer{}, file, opts)
+		require.Error(t, err, file)
+		require.True(t, errors.Is(err, ErrPolicyViolation), file)
+		require.Contains(t, err.Error(), violation)
+		require.Contains(t, err.Error(), file)
+	}
+	// the required recipient is only one of the members of the threshold
+	err = Clean(bytes.NewReader([]byte("secret")), &bytes.Buffer{}, "threshold/secret", opts)
+	require.Contains(t, err.Error(), "required recipient")
+	// encrypted content is copied as is
+	require.Equal(t, encrypted, clean(t, encrypted, "missing/secret", opts))
+	// files already siv at HEAD can still be changed
+	var siv bytes.Buffer
+	require.NoError(t, EncryptSIV(bytes.NewReader([]byte("old")), &siv, key))
+	repo.Head["siv/existing"] = siv.String()
+	encrypted = clean(t, "new", "siv/existing", opts)
+	require.Equal(t, "new", smudge(t, encrypted, "siv/existing", opts))
+
+	repo.WorkTree[PolicyFilename] = "min_recipients: 3\n"
+	err = Clean(bytes.NewReader([]byte("secret")), &bytes.Buffer{}, "ok/secret", opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "2 recipient(s), at least 3 are required")
+	repo.WorkTree[PolicyFilename] = "min_recipients: three\n"
+	err = Clean(bytes.NewReader([]byte("secret")), &bytes.Buffer{}, "ok/secret", opts)
+	require.ErrorIs(t, err, ErrInvalidPolicy)
+	require.Contains(t, err.Error(), PolicyFilename)
+	require.NotContains(t, err.Error(), "ok/secret")
+}
@@ -0,0 +1,576 @@
+package strongbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/plugin"
+)
+
+// AllowedSignersDirective in a recipient file adds the keys of a SSH
+// allowed_signers file, `@allowed-signers [path]`. The path is relative to the
+// root of the repository, without it Options.AllowedSignersFile is used. The
+// file must be in the repository.
+const AllowedSignersDirective = "@allowed-signers"
+
+// ErrNotRecipient is returned by RemoveRecipient if the key isn't in the
+// recipient file
+var ErrNotRecipient = errors.New("not a recipient")
+
+// InheritDirective in a recipient file adds the recipients of the parent
+// directory, those of the closest recipient file above it, `@inherit`.
+const InheritDirective = "@inherit"
+
+// NoneDirective in a recipient file leaves the files it governs unencrypted,
+// `@none`. It can't be combined with recipients.
+const NoneDirective = "@none"
+
+// recipientNameComment before a recipient in a recipient file names it,
+// `# name: alice`, see AddRecipient
+const recipientNameComment = "# name:"
+
+// Recipient is an age recipient read from a recipient file
+type Recipient struct {
+	age.Recipient
+	// Key is the public key, eg `age1...` or `ssh-ed25519 AAAA...`
+	Key string
+	// Name is who the key belongs to if known, the principals of an
+	// allowed_signers line or the comment of a SSH key
+	Name string
+}
+
+// String returns the name of the recipient, or its key if it has no name
+func (r Recipient) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Key
+}
+
+// ParseRecipients parses a recipient file, eg `.strongbox_recipient`. Each
+// line is either an age X25519 recipient (`age1...`), an age plugin recipient
+// (`age1<name>1...`), a SSH public key
+// (`ssh-ed25519` or `ssh-rsa`) in authorized_keys format or a line of a SSH
+// allowed_signers file. Empty lines and lines starting with # are ignored,
+// a `# name: <name>` comment names the recipient which follows it.
+// Directives, eg AllowedSignersDirective, are only supported by Clean and
+// plugins can't interact with the user, see Options.PluginUI.
+func ParseRecipients(r io.Reader) ([]age.Recipient, error) {
+	parsed, err := parseRecipients(r, nil, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	recipients := make([]age.Recipient, len(parsed))
+	for i, p := range parsed {
+		recipients[i] = p.Recipient
+	}
+	return recipients, nil
+}
+
+// FindRecipients returns the path of the closest `.strongbox_recipient` file
+// of filename and its recipients, with directives resolved, along with those
+// of the RecipientDirname next to it. path is empty if there is none, it's
+// the RecipientDirname if there is only the directory. recipients is empty if
+// the files are left unencrypted, see NoneDirective.
+func FindRecipients(filename string, opts Options) (path string, recipients []Recipient, err error) {
+	chain, recipients, err := findRecipientChain(filename, opts)
+	if err != nil || len(chain) == 0 {
+		return "", nil, err
+	}
+	return chain[0], recipients, nil
+}
+
+// RecipientChain returns the paths of the recipient files, or RecipientDirname
+// directories, the recipients of filename are loaded from: the one returned by
+// FindRecipients followed by those inherited with InheritDirective.
+func RecipientChain(filename string, opts Options) ([]string, error) {
+	chain, _, err := findRecipientChain(filename, opts)
+	return chain, err
+}
+
+func findRecipientChain(filename string, opts Options) (chain []string, recipients []Recipient, err error) {
+	path, content, err := findRepoFile(opts.Repository, filename, RecipientFilename, RecipientDirname)
+	if err != nil || path == "" {
+		return nil, nil, err
+	}
+	return loadRecipientsAt(opts.Repository, path, content, opts)
+}
+
+// loadRecipientsAt loads the recipients of path, a RecipientFilename or
+// RecipientDirname with content found by findRepoFile
+func loadRecipientsAt(repo Repository, path string, content []byte, opts Options) (chain []string, recipients []Recipient, err error) {
+	files, err := readRecipientFiles(repo, path, content)
+	if err != nil {
+		return nil, nil, err
+	}
+	return loadRecipients(repo, path, files, opts)
+}
+
+// inheritedRecipients returns the recipients of the parent of dir, for
+// InheritDirective
+func inheritedRecipients(repo Repository, dir string, opts Options) (chain []string, recipients []Recipient, err error) {
+	if filepath.Clean(dir) == "." {
+		return nil, nil, errors.New("nothing to inherit at the root of the repository")
+	}
+	// the search starts in the directory of the name given
+	path, content, err := FindKeyFile(repo, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case path == "":
+		return nil, nil, fmt.Errorf("no recipients to inherit above %s", dir)
+	case filepath.Base(path) == KeyIDFilename:
+		return nil, nil, fmt.Errorf("the siv key of %s can't be inherited", path)
+	}
+	return loadRecipientsAt(repo, path, content, opts)
+}
+
+// recipientFile is a file of recipients, name is the name of its recipients if
+// it's in a RecipientDirname
+type recipientFile struct {
+	path    string
+	content []byte
+	name    string
+}
+
+// readRecipientFiles returns the recipient files of the directory of path, a
+// RecipientFilename or RecipientDirname with content found by findRepoFile,
+// followed by the files of the RecipientDirname
+func readRecipientFiles(repo Repository, path string, content []byte) ([]recipientFile, error) {
+	var files []recipientFile
+	if filepath.Base(path) == RecipientFilename {
+		files = append(files, recipientFile{path: path, content: content})
+	}
+	dir := filepath.Join(filepath.Dir(path), RecipientDirname)
+	names, ok, err := readDir(repo, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		content, ok, err := repo.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// eg removed since the directory was listed
+		if !ok {
+			continue
+		}
+		files = append(files, recipientFile{
+			path:    path,
+			content: content,
+			name:    strings.TrimSuffix(name, filepath.Ext(name)),
+		})
+	}
+	if ok && len(files) == 0 {
+		return nil, fmt.Errorf("%s: no recipients found", dir)
+	}
+	return files, nil
+}
+
+// loadRecipients parses the recipient files of path, files referenced by
+// directives are read from repo. chain is path followed by the paths of the
+// inherited recipients.
+func loadRecipients(repo Repository, path string, files []recipientFile, opts Options) (chain []string, recipients []Recipient, err error) {
+	chain = []string{path}
+	threshold := 0
+	inherit, none := false, false
+	directive := func(directive, arg string) ([]Recipient, error) {
+		switch directive {
+		case InheritDirective, NoneDirective:
+			if arg != "" {
+				return nil, fmt.Errorf("unexpected argument %q", arg)
+			}
+			if directive == NoneDirective {
+				none = true
+				return nil, nil
+			}
+			if inherit {
+				return nil, errors.New("recipients can only be inherited once")
+			}
+			inherit = true
+			inheritedChain, inherited, err := inheritedRecipients(repo, filepath.Dir(path), opts)
+			chain = append(chain, inheritedChain...)
+			return inherited, err
+		case ThresholdDirective:
+			if threshold != 0 {
+				return nil, errors.New("only one threshold can be given")
+			}
+			k, err := strconv.Atoi(arg)
+			if err != nil || k < 1 {
+				return nil, fmt.Errorf("invalid threshold %q", arg)
+			}
+			threshold = k
+			return nil, nil
+		case AllowedSignersDirective:
+			return loadAllowedSigners(repo, arg, opts)
+		case PassphraseDirective:
+			recipient, err := newPassphraseRecipient(arg, opts)
+			return []Recipient{recipient}, err
+		}
+		return nil, fmt.Errorf("unknown directive %s", directive)
+	}
+	for _, file := range files {
+		parsed, err := parseRecipients(bytes.NewReader(file.content), opts.PluginUI, file.name, directive)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", file.path, err)
+		}
+		recipients = append(recipients, parsed...)
+	}
+	switch {
+	case none && (len(recipients) > 0 || threshold != 0 || inherit):
+		return nil, nil, fmt.Errorf("%s: %s can't be combined with recipients", path, NoneDirective)
+	case none:
+		return chain, nil, nil
+	case len(recipients) == 0:
+		return nil, nil, fmt.Errorf("%s: no recipients found", path)
+	}
+	for _, r := range recipients {
+		switch r.Recipient.(type) {
+		case passphraseRecipient:
+			if len(recipients) > 1 || threshold != 0 {
+				return nil, nil, fmt.Errorf("%s: %s can't be combined with other recipients", path, PassphraseDirective)
+			}
+		case thresholdRecipient:
+			// only if inherited
+			if len(recipients) > 1 || threshold != 0 {
+				return nil, nil, fmt.Errorf("%s: inherited %s recipients can't be combined with other recipients", path, ThresholdDirective)
+			}
+		}
+	}
+	if threshold != 0 {
+		recipient, err := newThresholdRecipient(threshold, recipients)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return chain, []Recipient{recipient}, nil
+	}
+	return chain, recipients, nil
+}
+
+// parseRecipients parses a recipient file, lines starting with @ are passed to
+// directive and plugin recipients use ui. The recipients of lines are named
+// fileName if it's set.
+func parseRecipients(r io.Reader, ui *plugin.ClientUI, fileName string, directive func(directive, arg string) ([]Recipient, error)) ([]Recipient, error) {
+	var recipients []Recipient
+	scanner := bufio.NewScanner(r)
+	var n, directives int
+	var name string
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, recipientNameComment) {
+			name = strings.TrimSpace(strings.TrimPrefix(line, recipientNameComment))
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "@") {
+			if directive == nil {
+				return nil, fmt.Errorf("directive at line %d is not supported here", n)
+			}
+			name, arg, _ := strings.Cut(line, " ")
+			resolved, err := directive(name, strings.TrimSpace(arg))
+			if err != nil {
+				return nil, fmt.Errorf("%s at line %d: %w", name, n, err)
+			}
+			recipients = append(recipients, resolved...)
+			directives++
+			name = ""
+			continue
+		}
+		recipient, err := parseRecipient(line, ui)
+		if err != nil {
+			return nil, fmt.Errorf("malformed recipient at line %d: %w", n, err)
+		}
+		if fileName != "" {
+			name = fileName
+		}
+		if name != "" {
+			recipient.Name, name = name, ""
+		}
+		recipients = append(recipients, recipient)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recipients file: %w", err)
+	}
+	if len(recipients) == 0 && directives == 0 {
+		return nil, errors.New("no recipients found")
+	}
+	return recipients, nil
+}
+
+func parseRecipient(s string, ui *plugin.ClientUI) (Recipient, error) {
+	fields := strings.Fields(s)
+	switch {
+	case isPluginRecipient(s):
+		// the plugin, `age-plugin-<name>`, is only run when encrypting
+		r, err := plugin.NewRecipient(s, pluginUI(ui))
+		return Recipient{Recipient: r, Key: s}, err
+	case strings.HasPrefix(s, "age1"):
+		r, err := age.ParseX25519Recipient(s)
+		return Recipient{Recipient: r, Key: s}, err
+	case isSSHKeyType(fields[0]):
+		return parseSSHRecipient(fields[0], fields[1:], "")
+	// authorized_keys lines may start with options, eg `from="..."`,
+	// otherwise it's an allowed_signers line starting with principals
+	case strings.Contains(fields[0], "="):
+		r, err := agessh.ParseRecipient(s)
+		if err != nil {
+			return Recipient{}, err
+		}
+		return Recipient{Recipient: r, Key: sshKey(s)}, nil
+	}
+	recipient, ok, err := parseAllowedSigner(s)
+	if err == nil && !ok {
+		err = errors.New("certificate authorities can't be recipients")
+	}
+	return recipient, err
+}
+
+func isSSHKeyType(s string) bool {
+	return strings.HasPrefix(s, "ssh-") || strings.HasPrefix(s, "ecdsa-") || strings.HasPrefix(s, "sk-")
+}
+
+// parseSSHRecipient parses a SSH public key, rest is the base64 key followed
+// by an optional comment
+func parseSSHRecipient(keyType string, rest []string, name string) (Recipient, error) {
+	if len(rest) == 0 {
+		return Recipient{}, fmt.Errorf("missing %s key", keyType)
+	}
+	key := keyType + " " + rest[0]
+	r, err := agessh.ParseRecipient(key)
+	if err != nil {
+		return Recipient{}, err
+	}
+	if name == "" && len(rest) > 1 {
+		name = strings.Join(rest[1:], " ")
+	}
+	return Recipient{Recipient: r, Key: key, Name: name}, nil
+}
+
+// sshKey returns the `<type> <base64>` part of an authorized_keys line
+func sshKey(line string) string {
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		if isSSHKeyType(f) && i+1 < len(fields) {
+			return f + " " + fields[i+1]
+		}
+	}
+	return line
+}
+
+// parseAllowedSigner parses a line of a SSH allowed_signers file,
+// `principals [options] keytype key`. ok is false for certificate
+// authorities, they don't identify a key to encrypt for.
+func parseAllowedSigner(line string) (recipient Recipient, ok bool, err error) {
+	fields := splitQuoted(line)
+	if len(fields) < 3 {
+		return Recipient{}, false, fmt.Errorf("malformed allowed signers line %q", line)
+	}
+	principals := strings.Trim(fields[0], `"`)
+	rest := fields[1:]
+	if !isSSHKeyType(rest[0]) {
+		options := strings.Split(rest[0], ",")
+		if slices.Contains(options, "cert-authority") {
+			return Recipient{}, false, nil
+		}
+		rest = rest[1:]
+	}
+	recipient, err = parseSSHRecipient(rest[0], rest[1:2], principals)
+	if err != nil {
+		return Recipient{}, false, fmt.Errorf("key of %s: %w", principals, err)
+	}
+	return recipient, true, nil
+}
+
+// splitQuoted splits s on spaces which aren't within double quotes
+func splitQuoted(s string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted := false
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			field.WriteRune(c)
+		case (c == ' ' || c == '\t') && !quoted:
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+		default:
+			field.WriteRune(c)
+		}
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// loadAllowedSigners returns the keys of a SSH allowed_signers file,
+// certificate authorities are skipped
+func loadAllowedSigners(repo Repository, path string, opts Options) ([]Recipient, error) {
+	if path == "" {
+		if opts.AllowedSignersFile == nil {
+			return nil, errors.New("no allowed signers file given")
+		}
+		var err error
+		if path, err = opts.AllowedSignersFile(); err != nil {
+			return nil, err
+		}
+		if path == "" {
+			return nil, errors.New("no allowed signers file configured (gpg.ssh.allowedSignersFile)")
+		}
+	}
+
+	// the file is read from the repository so that every clone encrypts for
+	// the same keys, and changes since HEAD are noticed
+	if !filepath.IsLocal(path) {
+		return nil, fmt.Errorf("allowed signers file %s isn't relative to the root of the repository", path)
+	}
+	content, ok, err := repo.ReadFile(path)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("%s not found", path)
+	}
+
+	var recipients []Recipient
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		recipient, ok, err := parseAllowedSigner(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, n, err)
+		}
+		if ok {
+			recipients = append(recipients, recipient)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no keys in %s", path)
+	}
+	return recipients, nil
+}
+
+// AddRecipient adds key, a line of a recipient file, to content, the content
+// of a recipient file. A non empty name is written in a `# name:` comment
+// before the key, it becomes the Name of the recipient.
+func AddRecipient(content []byte, key, name string) ([]byte, error) {
+	key = strings.TrimSpace(key)
+	if key == "" || strings.HasPrefix(key, "#") || strings.HasPrefix(key, "@") {
+		return nil, fmt.Errorf("malformed recipient %q", key)
+	}
+	recipient, err := parseRecipient(key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %w", key, err)
+	}
+	if lines := recipientLines(content, recipient.Key); len(lines) > 0 {
+		return nil, fmt.Errorf("%s is already a recipient at line %d", recipient.Key, lines[0]+1)
+	}
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		content = append(content, '\n')
+	}
+	if name = strings.TrimSpace(name); name != "" {
+		content = fmt.Appendf(content, "%s %s\n", recipientNameComment, name)
+	}
+	return fmt.Appendf(content, "%s\n", key), nil
+}
+
+// RemoveRecipient removes the lines of key, a recipient as accepted by
+// AddRecipient, and their `# name:` comments from content, the content of a
+// recipient file. Keys added by directives, eg AllowedSignersDirective, can't
+// be removed.
+func RemoveRecipient(content []byte, key string) ([]byte, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, errors.New("no recipient given")
+	}
+	recipient, err := parseRecipient(key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %w", key, err)
+	}
+	remove := recipientLines(content, recipient.Key)
+	if len(remove) == 0 {
+		return nil, fmt.Errorf("%s is %w", recipient.Key, ErrNotRecipient)
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	for _, i := range slices.Backward(remove) {
+		first := i
+		if i > 0 && strings.HasPrefix(strings.TrimSpace(lines[i-1]), recipientNameComment) {
+			first--
+		}
+		lines = slices.Delete(lines, first, i+1)
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// recipientLines returns the indexes of the lines of content whose recipient
+// has key
+func recipientLines(content []byte, key string) []int {
+	var found []int
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
+		}
+		if r, err := parseRecipient(line, nil); err == nil && r.Key == key {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+// recipientKeys returns the sorted keys of recipients
+func recipientKeys(recipients []Recipient) []string {
+	keys := make([]string, len(recipients))
+	for i, r := range recipients {
+		keys[i] = r.Key
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// headRepository is the HEAD commit of a repository
+type headRepository struct {
+	Repository
+}
+
+func (r headRepository) ReadFile(name string) ([]byte, bool, error) {
+	return r.Repository.ReadFileAtHEAD(name)
+}
+
+func (r headRepository) ReadDir(name string) ([]string, bool, error) {
+	return r.ReadDirAtHEAD(name)
+}
+
+func (r headRepository) ReadDirAtHEAD(name string) ([]string, bool, error) {
+	if repo, ok := r.Repository.(DirRepository); ok {
+		return repo.ReadDirAtHEAD(name)
+	}
+	return nil, false, nil
+}
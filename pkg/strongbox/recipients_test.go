@@ -0,0 +1,315 @@
+package strongbox
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"maps"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox/strongboxtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSSHKey(t *testing.T) (ed25519.PrivateKey, string) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return key, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+func TestAllowedSigners(t *testing.T) {
+	aliceKey, alice := newSSHKey(t)
+	_, bob := newSSHKey(t)
+	_, ca := newSSHKey(t)
+	aliceIdentity, err := ParseSSHIdentity(mustMarshalSSHKey(t, aliceKey), nil)
+	require.NoError(t, err)
+
+	allowedSigners := strings.Join([]string{
+		"# team",
+		"alice@example.com " + alice,
+		`"bob@example.com,robert@example.com" namespaces="git,file" ` + bob + " bob's laptop",
+		"*@example.com cert-authority " + ca,
+	}, "\n")
+	repo := strongboxtest.MemRepository{
+		WorkTree: map[string]string{
+			".allowed_signers":             allowedSigners,
+			"secrets/" + RecipientFilename: AllowedSignersDirective + " .allowed_signers\n",
+		},
+		Head: map[string]string{},
+	}
+	opts := Options{Identities: []age.Identity{aliceIdentity}, Repository: repo}
+
+	path, recipients, err := FindRecipients("secrets/secret", opts)
+	require.NoError(t, err)
+	require.Equal(t, "secrets/"+RecipientFilename, path)
+	var names []string
+	for _, r := range recipients {
+		names = append(names, r.String())
+	}
+	require.Equal(t, []string{"alice@example.com", "bob@example.com,robert@example.com"}, names)
+
+	encrypted := clean(t, "secret\n", "secrets/secret", opts)
+	require.Equal(t, "secret\n", smudge(t, encrypted, "secrets/secret", opts))
+
+	// unchanged since HEAD
+	repo.Head["secrets/secret"] = encrypted
+	repo.Head["secrets/"+RecipientFilename] = repo.WorkTree["secrets/"+RecipientFilename]
+	repo.Head[".allowed_signers"] = allowedSigners
+	require.Equal(t, encrypted, clean(t, "secret\n", "secrets/secret", opts))
+	// a signer was removed since HEAD
+	repo.WorkTree[".allowed_signers"] = "alice@example.com " + alice + "\n"
+	require.NotEqual(t, encrypted, clean(t, "secret\n", "secrets/secret", opts))
+
+	// allowed signers lines directly in the recipient file, and the file
+	// configured in git
+	repo.WorkTree["secrets/"+RecipientFilename] = "carol@example.com " + bob + "\n" + AllowedSignersDirective + "\n"
+	opts.AllowedSignersFile = func() (string, error) { return ".allowed_signers", nil }
+	_, recipients, err = FindRecipients("secrets/secret", opts)
+	require.NoError(t, err)
+	require.Len(t, recipients, 2)
+	require.Equal(t, "carol@example.com", recipients[0].Name)
+
+	// the configured file is compared with HEAD too
+	repo.WorkTree["secrets/"+RecipientFilename] = AllowedSignersDirective + "\n"
+	repo.Head["secrets/"+RecipientFilename] = AllowedSignersDirective + "\n"
+	repo.Head[".allowed_signers"] = repo.WorkTree[".allowed_signers"]
+	encrypted = clean(t, "secret\n", "secrets/secret", opts)
+	repo.Head["secrets/secret"] = encrypted
+	require.Equal(t, encrypted, clean(t, "secret\n", "secrets/secret", opts))
+	repo.WorkTree[".allowed_signers"] = allowedSigners
+	require.NotEqual(t, encrypted, clean(t, "secret\n", "secrets/secret", opts))
+
+	// files outside of the repository would differ between clones
+	opts.AllowedSignersFile = func() (string, error) { return filepath.Join(t.TempDir(), "allowed_signers"), nil }
+	_, _, err = FindRecipients("secrets/secret", opts)
+	require.Error(t, err)
+	repo.WorkTree["secrets/"+RecipientFilename] = AllowedSignersDirective + " ../allowed_signers\n"
+	_, _, err = FindRecipients("secrets/secret", opts)
+	require.Error(t, err)
+
+	opts.AllowedSignersFile = nil
+	repo.WorkTree["secrets/"+RecipientFilename] = AllowedSignersDirective + "\n"
+	_, _, err = FindRecipients("secrets/secret", opts)
+	require.Error(t, err)
+	_, err = ParseRecipients(strings.NewReader(AllowedSignersDirective + "\n"))
+	require.Error(t, err)
+}
+
+func TestAddRemoveRecipient(t *testing.T) {
+	alice, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	bob, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	_, carol := newSSHKey(t)
+
+	content := []byte("# team\n" + alice.Recipient().String())
+	content, err = AddRecipient(content, bob.Recipient().String(), "bob")
+	require.NoError(t, err)
+	content, err = AddRecipient(content, carol+" carol@laptop", "")
+	require.NoError(t, err)
+	require.Equal(t, "# team\n"+alice.Recipient().String()+"\n# name: bob\n"+bob.Recipient().String()+"\n"+carol+" carol@laptop\n", string(content))
+	_, err = AddRecipient(content, bob.Recipient().String(), "robert")
+	require.Error(t, err)
+	_, err = AddRecipient(content, "age1nope", "")
+	require.Error(t, err)
+
+	recipients, err := parseRecipients(bytes.NewReader(content), nil, "", nil)
+	require.NoError(t, err)
+	var names []string
+	for _, r := range recipients {
+		names = append(names, r.String())
+	}
+	require.Equal(t, []string{alice.Recipient().String(), "bob", "carol@laptop"}, names)
+
+	// the SSH key is found without its comment, the name comment goes too
+	removed, err := RemoveRecipient(content, carol)
+	require.NoError(t, err)
+	removed, err = RemoveRecipient(removed, bob.Recipient().String())
+	require.NoError(t, err)
+	require.Equal(t, "# team\n"+alice.Recipient().String()+"\n", string(removed))
+	_, err = RemoveRecipient(removed, bob.Recipient().String())
+	require.Error(t, err)
+}
+
+func TestReencrypt(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	repo := strongboxtest.MemRepository{
+		WorkTree: map[string]string{RecipientFilename: identity.Recipient().String()},
+		Head:     map[string]string{},
+	}
+	opts := Options{Repository: repo, Identities: []age.Identity{identity}}
+	encrypted := clean(t, "secret", "secret", opts)
+	repo.Head["secret"] = encrypted
+	repo.Head[RecipientFilename] = repo.WorkTree[RecipientFilename]
+	require.Equal(t, encrypted, clean(t, "secret", "secret", opts))
+
+	opts.Reencrypt = true
+	reencrypted := clean(t, "secret", "secret", opts)
+	require.NotEqual(t, encrypted, reencrypted)
+	require.Equal(t, "secret", smudge(t, reencrypted, "secret", opts))
+}
+
+func TestRecipientDir(t *testing.T) {
+	alice, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	bob, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	carol, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	repo := strongboxtest.MemRepository{
+		WorkTree: map[string]string{
+			"secrets/" + RecipientFilename:                      alice.Recipient().String() + "\n",
+			"secrets/" + RecipientDirname + "/bob.pub":          "# laptop\n" + bob.Recipient().String() + "\n",
+			"secrets/" + RecipientDirname + "/ci-prod.pub":      carol.Recipient().String() + "\n",
+			"secrets/" + RecipientDirname + "/.ci-prod.pub.swp": "garbage",
+			"other/" + RecipientDirname + "/carol.pub":          carol.Recipient().String() + "\n",
+		},
+		Head: map[string]string{},
+	}
+	opts := Options{Repository: repo}
+
+	path, recipients, err := FindRecipients("secrets/app/secret", opts)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("secrets", RecipientFilename), path)
+	var names []string
+	for _, r := range recipients {
+		names = append(names, r.String())
+	}
+	require.Equal(t, []string{alice.Recipient().String(), "bob", "ci-prod"}, names)
+
+	// instead of the file
+	path, recipients, err = FindRecipients("other/secret", opts)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("other", RecipientDirname), path)
+	require.Len(t, recipients, 1)
+	require.Equal(t, "carol", recipients[0].Name)
+	keyFile, _, err := FindKeyFile(repo, "other/secret")
+	require.NoError(t, err)
+	require.Equal(t, path, keyFile)
+
+	encrypted := clean(t, "secret", "other/secret", opts)
+	require.Equal(t, "secret", smudge(t, encrypted, "other/secret", Options{Repository: repo, Identities: []age.Identity{carol}}))
+	encrypted = clean(t, "secret", "secrets/secret", opts)
+	for _, identity := range []*age.X25519Identity{alice, bob, carol} {
+		require.Equal(t, "secret", smudge(t, encrypted, "secrets/secret", Options{Repository: repo, Identities: []age.Identity{identity}}))
+	}
+
+	// files of the directory are checked like recipient files
+	repo.WorkTree["other/"+RecipientDirname+"/dave.pub"] = "age1nope\n"
+	_, _, err = FindRecipients("other/secret", opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), filepath.Join("other", RecipientDirname, "dave.pub"))
+}
+
+func TestRecipientDirChanged(t *testing.T) {
+	alice, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	bob, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	repo := strongboxtest.MemRepository{
+		WorkTree: map[string]string{RecipientDirname + "/alice.pub": alice.Recipient().String()},
+		Head:     map[string]string{},
+	}
+	opts := Options{Repository: repo, Identities: []age.Identity{alice}}
+	encrypted := clean(t, "secret", "secret", opts)
+	repo.Head["secret"] = encrypted
+	repo.Head[RecipientDirname+"/alice.pub"] = alice.Recipient().String()
+	require.Equal(t, encrypted, clean(t, "secret", "secret", opts))
+
+	repo.WorkTree[RecipientDirname+"/bob.pub"] = bob.Recipient().String()
+	reencrypted := clean(t, "secret", "secret", opts)
+	require.NotEqual(t, encrypted, reencrypted)
+	require.Equal(t, "secret", smudge(t, reencrypted, "secret", Options{Repository: repo, Identities: []age.Identity{bob}}))
+}
+
+func TestInheritRecipients(t *testing.T) {
+	alice, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	bob, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	carol, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	repo := strongboxtest.MemRepository{
+		WorkTree: map[string]string{
+			RecipientFilename:                          alice.Recipient().String() + "\n",
+			"secrets/" + RecipientDirname + "/bob.pub": InheritDirective + "\n" + bob.Recipient().String() + "\n",
+			"secrets/ci/" + RecipientFilename:          "# ci can only read its secrets\n" + InheritDirective + "\n" + carol.Recipient().String() + "\n",
+			"public/" + RecipientFilename:              NoneDirective + "\n",
+		},
+		Head: map[string]string{},
+	}
+	opts := Options{Repository: repo}
+
+	chain, err := RecipientChain("secrets/ci/token", opts)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join("secrets/ci", RecipientFilename), filepath.Join("secrets", RecipientDirname), RecipientFilename}, chain)
+	path, recipients, err := FindRecipients("secrets/ci/token", opts)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("secrets/ci", RecipientFilename), path)
+	var names []string
+	for _, r := range recipients {
+		names = append(names, r.String())
+	}
+	// inherited recipients aren't named after the file of the directive
+	require.Equal(t, []string{alice.Recipient().String(), "bob", carol.Recipient().String()}, names)
+
+	encrypted := clean(t, "token", "secrets/ci/token", opts)
+	for _, identity := range []*age.X25519Identity{alice, bob, carol} {
+		require.Equal(t, "token", smudge(t, encrypted, "secrets/ci/token", Options{Repository: repo, Identities: []age.Identity{identity}}))
+	}
+
+	// a change of the parent re-encrypts the files inheriting it
+	opts.Identities = []age.Identity{carol}
+	for name, content := range repo.WorkTree {
+		repo.Head[name] = content
+	}
+	repo.Head["secrets/ci/token"] = encrypted
+	require.Equal(t, encrypted, clean(t, "token", "secrets/ci/token", opts))
+	repo.WorkTree[RecipientFilename] = carol.Recipient().String() + "\n"
+	reencrypted := clean(t, "token", "secrets/ci/token", opts)
+	require.NotEqual(t, encrypted, reencrypted)
+	_, err = ageDecrypt([]byte(reencrypted), []age.Identity{alice})
+	require.Error(t, err)
+
+	// left unencrypted
+	path, recipients, err = FindRecipients("public/readme", opts)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("public", RecipientFilename), path)
+	require.Empty(t, recipients)
+	require.Equal(t, "hello", clean(t, "hello", "public/readme", opts))
+
+	repo.WorkTree["siv/"+KeyIDFilename] = "ejDHqNvTRAvC1ZT0aiItGpnqEN8KaLGjeJOZXZt5fB8=\n"
+	repo.WorkTree["threshold/"+RecipientFilename] = ThresholdDirective + " 1\n" + alice.Recipient().String() + "\n"
+	for name, content := range map[string]string{
+		RecipientFilename:                  InheritDirective + "\n",
+		"a/" + RecipientFilename:           InheritDirective + "\n" + InheritDirective + "\n",
+		"b/" + RecipientFilename:           NoneDirective + "\n" + alice.Recipient().String() + "\n",
+		"c/" + RecipientFilename:           InheritDirective + " ..\n",
+		"public/d/" + RecipientFilename:    InheritDirective + "\n",
+		"siv/e/" + RecipientFilename:       InheritDirective + "\n" + alice.Recipient().String() + "\n",
+		"threshold/f/" + RecipientFilename: InheritDirective + "\n" + bob.Recipient().String() + "\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			workTree := maps.Clone(repo.WorkTree)
+			workTree[name] = content
+			_, _, err := FindRecipients(filepath.Join(filepath.Dir(name), "secret"), Options{Repository: strongboxtest.MemRepository{WorkTree: workTree}})
+			require.Error(t, err)
+		})
+	}
+}
+
+func mustMarshalSSHKey(t *testing.T, key ed25519.PrivateKey) []byte {
+	t.Helper()
+	block, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err)
+	return pem.EncodeToMemory(block)
+}
@@ -0,0 +1,168 @@
+package strongbox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jacobsa/crypto/siv"
+)
+
+var (
+	// Prefix is the start of every siv encrypted resource
+	Prefix        = []byte("# STRONGBOX ENCRYPTED RESOURCE ;")
+	defaultPrefix = []byte("# STRONGBOX ENCRYPTED RESOURCE ; See https://github.com/uw-labs/strongbox\n")
+)
+
+// EncryptSIV encrypts plaintext read from r with a siv key and writes the
+// encrypted resource to w
+func EncryptSIV(r io.Reader, w io.Writer, key []byte) error {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	out, err := encryptSIV(in, key)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func encryptSIV(b, key []byte) ([]byte, error) {
+	b, err := compress(b)
+	if err != nil {
+		return nil, err
+	}
+	out, err := siv.Encrypt(nil, key, b, nil)
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	buf = append(buf, defaultPrefix...)
+	b64 := encode(out)
+	for len(b64) > 0 {
+		l := 76
+		if len(b64) < 76 {
+			l = len(b64)
+		}
+		buf = append(buf, b64[0:l]...)
+		buf = append(buf, '\n')
+		b64 = b64[l:]
+	}
+	return buf, nil
+}
+
+func decryptSIV(enc []byte, priv []byte) ([]byte, error) {
+	// strip prefix and any comment up to end of line
+	spl := bytes.SplitN(enc, []byte("\n"), 2)
+	if len(spl) != 2 {
+		return nil, errors.New("couldn't split on end of line")
+	}
+	b64encoded := spl[1]
+	b64decoded, err := decode(b64encoded)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := siv.Decrypt(priv, b64decoded, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(decrypted)
+}
+
+func sivCheckFraming(enc []byte) error {
+	spl := bytes.SplitN(enc, []byte("\n"), 2)
+	if len(spl) != 2 {
+		return errors.New("invalid siv resource: couldn't split on end of line")
+	}
+	b, err := decode(spl[1])
+	if err != nil {
+		return fmt.Errorf("invalid siv resource: %w", err)
+	}
+	// at least the siv tag
+	if len(b) <= 16 {
+		return errors.New("invalid siv resource: too short")
+	}
+	return nil
+}
+
+// decryptWithKeyRing tries every key in the keyring, siv is authenticated so
+// only the right key will decrypt the content
+func decryptWithKeyRing(enc []byte, keyRing KeyRing) ([]byte, error) {
+	if keyRing == nil {
+		return nil, ErrKeyNotFound
+	}
+	if d, ok := keyRing.(SIVDecrypter); ok {
+		return d.DecryptSIV(enc)
+	}
+	keys, err := keyRing.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if out, err := decryptSIV(enc, key); err == nil {
+			return out, nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+func compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress: %w", err)
+	}
+	b, err = io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress: %w", err)
+	}
+	if err := zr.Close(); err != nil {
+		return nil, fmt.Errorf("unable to decompress: %w", err)
+	}
+	return b, nil
+}
+
+func encode(decoded []byte) []byte {
+	b64 := make([]byte, base64.StdEncoding.EncodedLen(len(decoded)))
+	base64.StdEncoding.Encode(b64, decoded)
+	return b64
+}
+
+func decode(encoded []byte) ([]byte, error) {
+	decoded := make([]byte, len(encoded))
+	i, err := base64.StdEncoding.Decode(decoded, encoded)
+	if err != nil {
+		return nil, err
+	}
+	return decoded[0:i], nil
+}
+
+// ParseKeyID parses the content of a `.strongbox-keyid` file
+func ParseKeyID(content []byte) ([]byte, error) {
+	b64 := strings.TrimSpace(string(content))
+	b, err := decode([]byte(b64))
+	if err != nil {
+		return []byte{}, err
+	}
+	if len(b) != 32 {
+		return []byte{}, fmt.Errorf("unexpected key length %d", len(b))
+	}
+	return b, nil
+}
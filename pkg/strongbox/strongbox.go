@@ -0,0 +1,346 @@
+// Package strongbox encrypts and decrypts files the same way as the strongbox
+// git filters, it can be used to read strongbox encrypted secrets at runtime.
+//
+// Age files are armored age files, siv files start with Prefix. Which
+// recipients or key a file is encrypted for is decided by the closest
+// `.strongbox_recipient` (age) or `.strongbox-keyid` (siv) file.
+package strongbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+)
+
+const (
+	RecipientFilename = ".strongbox_recipient"
+	KeyIDFilename     = ".strongbox-keyid"
+	// RecipientDirname is a directory of recipient files next to, or instead
+	// of, RecipientFilename, eg `alice.pub`. Their recipients are added to
+	// those of RecipientFilename and named after the file, without its
+	// extension. Hidden files are ignored.
+	RecipientDirname = ".strongbox_recipients.d"
+)
+
+var (
+	// ErrNoIdentities is returned when decrypting an age file without any
+	// identities
+	ErrNoIdentities = errors.New("no age identities")
+	// ErrNotEncrypted is returned when decrypting content which is neither
+	// an age nor a siv file
+	ErrNotEncrypted = errors.New("not a strongbox encrypted resource")
+	// errUnencrypted is returned by findRecipients for files governed by
+	// NoneDirective, Clean stores them as is
+	errUnencrypted = errors.New("left unencrypted")
+)
+
+// Repository gives Clean and Smudge access to the files of a repository,
+// names are relative to the root of the repository
+type Repository interface {
+	// ReadFile returns the content of a file in the working tree, ok is
+	// false if it doesn't exist
+	ReadFile(name string) (content []byte, ok bool, err error)
+	// ReadFileAtHEAD returns the content of a file in the HEAD commit, ok is
+	// false if it doesn't exist
+	ReadFileAtHEAD(name string) (content []byte, ok bool, err error)
+}
+
+// DirRepository is a Repository which can list directories, it's required to
+// find RecipientDirname directories
+type DirRepository interface {
+	Repository
+	// ReadDir returns the sorted names of the files of a directory in the
+	// working tree, ok is false if it doesn't exist
+	ReadDir(name string) (names []string, ok bool, err error)
+	// ReadDirAtHEAD returns the sorted names of the files of a directory in
+	// the HEAD commit, ok is false if it doesn't exist
+	ReadDirAtHEAD(name string) (names []string, ok bool, err error)
+}
+
+// Options configures Clean and Smudge
+type Options struct {
+	// Identities are used to decrypt age files
+	Identities []age.Identity
+	// KeyRing holds the keys of siv files
+	KeyRing KeyRing
+	// Repository is used to find recipient and key-id files and files at
+	// HEAD, it's required
+	Repository Repository
+	// LeftEncrypted, if set, is called by Smudge with the reason a file
+	// couldn't be decrypted. The file is copied as is unless LeftEncrypted
+	// returns an error, in which case Smudge fails with that error
+	LeftEncrypted func(filename string, err error) error
+	// AllowedSignersFile, if set, returns the path of the SSH allowed_signers
+	// file used by AllowedSignersDirective without a path, relative to the
+	// root of the repository
+	AllowedSignersFile func() (string, error)
+	// Passphrase, if set, returns the passphrase of the PassphraseDirective
+	// with name, it's called when encrypting and decrypting files with it
+	Passphrase func(name string) ([]byte, error)
+	// PluginUI is used by age plugin recipients to display messages and
+	// prompt the user when encrypting, plugin requests fail if it's nil
+	PluginUI *plugin.ClientUI
+	// Reencrypt makes Clean encrypt age files again even if their plaintext
+	// and recipients haven't changed since HEAD
+	Reencrypt bool
+}
+
+// IsEncrypted returns true if content is an age or siv encrypted resource
+func IsEncrypted(content []byte) bool {
+	return isAge(content) || bytes.HasPrefix(content, Prefix)
+}
+
+// CheckFraming checks content is a well formed age or siv encrypted resource
+// without decrypting it, eg to validate pushes on a server without keys
+func CheckFraming(content []byte) error {
+	switch {
+	case isAge(content):
+		return ageCheckFraming(content)
+	case bytes.HasPrefix(content, Prefix):
+		return sivCheckFraming(content)
+	}
+	return ErrNotEncrypted
+}
+
+// Decrypt decrypts an age or siv file read from r and writes the plaintext to
+// w. Age files are decrypted with identities, siv files with whichever key of
+// keyRing they were encrypted with.
+func Decrypt(r io.Reader, w io.Writer, identities []age.Identity, keyRing KeyRing) error {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var out []byte
+	switch {
+	case isAge(in):
+		out, err = ageDecrypt(in, identities)
+	case bytes.HasPrefix(in, Prefix):
+		out, err = decryptWithKeyRing(in, keyRing)
+	default:
+		err = ErrNotEncrypted
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// Clean encrypts a file the same way as the git clean filter. Content which
+// is already encrypted is copied as is, otherwise it's encrypted for the
+// closest recipient or key-id file of filename, or copied as is if the
+// recipient file has NoneDirective. Age files whose plaintext and recipients
+// haven't changed since HEAD are not re-encrypted. Files whose recipients
+// violate the policy of the repository, see PolicyFilename, are refused
+// unless they are already encrypted with siv at HEAD. A policy which can't be
+// parsed is an ErrInvalidPolicy error.
+func Clean(r io.Reader, w io.Writer, filename string, opts Options) error {
+	if opts.Repository == nil {
+		return errors.New("strongbox: Options.Repository is required")
+	}
+	// Read the file, fail on error
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// Check the file is plaintext, if its an encrypted strongbox or age file, copy as is
+	if IsEncrypted(in) {
+		_, err = io.Copy(w, bytes.NewReader(in))
+		return err
+	}
+	// File is plaintext and needs to be encrypted, get the recipient or a
+	// key, fail on error
+	recipients, key, err := findRecipients(filename, opts)
+	if err != nil && !errors.Is(err, errUnencrypted) {
+		return err
+	}
+	backend := BackendAge
+	switch {
+	case errors.Is(err, errUnencrypted):
+		backend = BackendNone
+	case recipients == nil:
+		backend = BackendSIV
+	}
+	policy, err := FindPolicy(opts.Repository)
+	if err != nil {
+		return err
+	}
+	sivAtHEAD := false
+	if backend == BackendSIV && policy != nil {
+		// files which are already siv can still be changed, the policy only
+		// stops new ones while migrating to age
+		head, ok, err := opts.Repository.ReadFileAtHEAD(filename)
+		if err != nil {
+			return err
+		}
+		sivAtHEAD = ok && bytes.HasPrefix(head, Prefix)
+	}
+	if !sivAtHEAD {
+		if err := policy.Check(backend, recipients); err != nil {
+			return fmt.Errorf("refusing to encrypt %s: %w (%s)", filename, err, PolicyFilename)
+		}
+	}
+
+	switch backend {
+	case BackendNone:
+		_, err = io.Copy(w, bytes.NewReader(in))
+		return err
+	case BackendAge:
+		// found recipient file and plaintext differs from HEAD
+		ageRecipients := make([]age.Recipient, len(recipients))
+		for i, r := range recipients {
+			ageRecipients[i] = r.Recipient
+		}
+		return ageEncrypt(w, ageRecipients, in, filename, opts)
+	}
+	// encrypt the file, fail on error
+	return EncryptSIV(bytes.NewReader(in), w, key)
+}
+
+// Smudge decrypts a file the same way as the git smudge filter. Files which
+// can't be decrypted are copied as is, see Options.LeftEncrypted.
+func Smudge(r io.Reader, w io.Writer, filename string, opts Options) error {
+	if opts.Repository == nil {
+		return errors.New("strongbox: Options.Repository is required")
+	}
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	out := in
+	switch {
+	case isAge(in):
+		out, err = ageDecrypt(in, ageIdentities(in, filename, opts))
+	case bytes.HasPrefix(in, Prefix):
+		out, err = smudgeSIV(in, filename, opts)
+	}
+	if err != nil {
+		if opts.LeftEncrypted != nil {
+			if err := opts.LeftEncrypted(filename, err); err != nil {
+				return err
+			}
+		}
+		// Couldn't decrypt, just copy as is
+		out = in
+	}
+	_, err = io.Copy(w, bytes.NewReader(out))
+	return err
+}
+
+func smudgeSIV(in []byte, filename string, opts Options) ([]byte, error) {
+	if opts.KeyRing == nil {
+		return nil, ErrKeyNotFound
+	}
+	keyID, err := FindKeyID(opts.Repository, filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := opts.KeyRing.Key(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("key-id %s: %w", encode(keyID), err)
+	}
+	return decryptSIV(in, key)
+}
+
+// FindKeyID returns the siv key-id of the closest `.strongbox-keyid` file of
+// filename
+func FindKeyID(repo Repository, filename string) ([]byte, error) {
+	path, content, err := findRepoFile(repo, filename, KeyIDFilename)
+	if err != nil {
+		return []byte{}, err
+	}
+	if path == "" {
+		return []byte{}, fmt.Errorf("failed to find key id for file %s", filename)
+	}
+	return ParseKeyID(content)
+}
+
+// FindKeyFile returns the path and content of the closest
+// `.strongbox_recipient` or `.strongbox-keyid` file of filename, the one Clean
+// encrypts it with. path is empty if there is none. It's the path of the
+// RecipientDirname directory, with no content, if there is no
+// `.strongbox_recipient` next to it.
+func FindKeyFile(repo Repository, filename string) (path string, content []byte, err error) {
+	return findRepoFile(repo, filename, RecipientFilename, RecipientDirname, KeyIDFilename)
+}
+
+// Finds closest age recipient or siv keyid
+func findRecipients(filename string, opts Options) ([]Recipient, []byte, error) {
+	path, content, err := FindKeyFile(opts.Repository, filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch filepath.Base(path) {
+	// If we found `.strongbox_recipient` - parse it and return
+	case RecipientFilename, RecipientDirname:
+		_, parsed, err := loadRecipientsAt(opts.Repository, path, content, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(parsed) == 0 {
+			return nil, nil, errUnencrypted
+		}
+		return parsed, nil, nil
+	// If we found `strongbox-keyid` - get the corresponding key and return it
+	case KeyIDFilename:
+		keyID, err := ParseKeyID(content)
+		if err != nil {
+			return nil, nil, err
+		}
+		if opts.KeyRing == nil {
+			return nil, nil, ErrKeyNotFound
+		}
+		key, err := opts.KeyRing.Key(keyID)
+		return nil, key, err
+	}
+	return nil, nil, fmt.Errorf("failed to find recipient or keyid for file %s", filename)
+}
+
+// findRepoFile walks up the directory tree from filename and returns the path
+// and content of the closest file with one of the given names, names are
+// checked in order in each directory. path is empty if nothing is found. A
+// RecipientDirname directory is found like a file, without content.
+func findRepoFile(repo Repository, filename string, names ...string) (path string, content []byte, err error) {
+	dir := filepath.Dir(filename)
+	for {
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			if name == RecipientDirname {
+				if _, ok, err := readDir(repo, path); err != nil {
+					return "", nil, err
+				} else if ok {
+					return path, nil, nil
+				}
+				continue
+			}
+			content, ok, err := repo.ReadFile(path)
+			if err != nil {
+				return "", nil, err
+			}
+			if ok {
+				return path, content, nil
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil, nil
+		}
+		dir = parent
+	}
+}
+
+// readDir lists a directory of repo, ok is false if it doesn't exist or repo
+// isn't a DirRepository
+func readDir(repo Repository, name string) (names []string, ok bool, err error) {
+	dirRepo, isDirRepo := repo.(DirRepository)
+	if !isDirRepo {
+		return nil, false, nil
+	}
+	return dirRepo.ReadDir(name)
+}
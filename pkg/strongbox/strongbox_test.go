@@ -0,0 +1,124 @@
+package strongbox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox/strongboxtest"
+)
+
+func clean(t *testing.T, plaintext, filename string, opts Options) string {
+	t.Helper()
+	var out bytes.Buffer
+	require.NoError(t, Clean(strings.NewReader(plaintext), &out, filename, opts))
+	return out.String()
+}
+
+func smudge(t *testing.T, encrypted, filename string, opts Options) string {
+	t.Helper()
+	var out bytes.Buffer
+	require.NoError(t, Smudge(strings.NewReader(encrypted), &out, filename, opts))
+	return out.String()
+}
+
+func TestCleanSmudgeAge(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	repo := strongboxtest.MemRepository{
+		WorkTree: map[string]string{
+			"secrets/" + RecipientFilename: identity.Recipient().String() + "\n",
+		},
+		Head: map[string]string{},
+	}
+	opts := Options{Identities: []age.Identity{identity}, Repository: repo}
+
+	plaintext := "t0ps3cret\n"
+	encrypted := clean(t, plaintext, "secrets/dir/secret", opts)
+	require.True(t, IsEncrypted([]byte(encrypted)))
+	require.Equal(t, plaintext, smudge(t, encrypted, "secrets/dir/secret", opts))
+	require.Equal(t, encrypted, clean(t, encrypted, "secrets/dir/secret", opts), "encrypted content should be copied as is")
+
+	// unchanged since HEAD, should not be re-encrypted
+	repo.Head["secrets/dir/secret"] = encrypted
+	repo.Head["secrets/"+RecipientFilename] = repo.WorkTree["secrets/"+RecipientFilename]
+	require.Equal(t, encrypted, clean(t, plaintext, "secrets/dir/secret", opts))
+
+	// recipient changed, should be re-encrypted
+	repo.Head["secrets/"+RecipientFilename] = "# old recipient\n"
+	require.NotEqual(t, encrypted, clean(t, plaintext, "secrets/dir/secret", opts))
+
+	// without identities the ciphertext is copied as is
+	var leftEncrypted error
+	noIdentities := Options{
+		Repository: repo,
+		LeftEncrypted: func(filename string, err error) error {
+			leftEncrypted = err
+			return nil
+		},
+	}
+	require.Equal(t, encrypted, smudge(t, encrypted, "secrets/dir/secret", noIdentities))
+	require.ErrorIs(t, leftEncrypted, ErrNoIdentities)
+
+	// unless LeftEncrypted fails
+	noIdentities.LeftEncrypted = func(filename string, err error) error { return err }
+	var out bytes.Buffer
+	require.ErrorIs(t, Smudge(strings.NewReader(encrypted), &out, "secrets/dir/secret", noIdentities), ErrNoIdentities)
+	require.Empty(t, out.String())
+}
+
+func TestCleanSmudgeSIV(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	keyID := sha256.Sum256(key)
+	repo := strongboxtest.MemRepository{
+		WorkTree: map[string]string{
+			KeyIDFilename: string(encode(keyID[:])),
+		},
+	}
+	opts := Options{KeyRing: StaticKeyRing{key}, Repository: repo}
+
+	plaintext := "t0ps3cret\n"
+	encrypted := clean(t, plaintext, "secret", opts)
+	require.True(t, strings.HasPrefix(encrypted, string(Prefix)))
+	require.Equal(t, plaintext, smudge(t, encrypted, "secret", opts))
+
+	var out bytes.Buffer
+	require.NoError(t, Decrypt(strings.NewReader(encrypted), &out, nil, StaticKeyRing{key}))
+	require.Equal(t, plaintext, out.String())
+
+	// corrupt content is reported rather than crashing
+	corrupt, err := encryptSIV([]byte(plaintext), key)
+	require.NoError(t, err)
+	corrupt[len(defaultPrefix)+1] ^= 1
+	require.Error(t, Decrypt(bytes.NewReader(corrupt), &out, nil, StaticKeyRing{key}))
+
+	require.ErrorIs(t, Decrypt(strings.NewReader(plaintext), &out, nil, StaticKeyRing{key}), ErrNotEncrypted)
+}
+
+func TestCheckFraming(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	require.NoError(t, err)
+
+	var ageEnc, sivEnc bytes.Buffer
+	require.NoError(t, Encrypt(strings.NewReader("secret"), &ageEnc, []age.Recipient{identity.Recipient()}))
+	require.NoError(t, EncryptSIV(strings.NewReader("secret"), &sivEnc, key))
+	require.NoError(t, CheckFraming(ageEnc.Bytes()))
+	require.NoError(t, CheckFraming(sivEnc.Bytes()))
+
+	require.ErrorIs(t, CheckFraming([]byte("secret")), ErrNotEncrypted)
+	require.Error(t, CheckFraming(append(bytes.Clone(sivEnc.Bytes()[:len(defaultPrefix)]), "not base64!\n"...)))
+	require.Error(t, CheckFraming(append(bytes.Clone(sivEnc.Bytes()[:len(defaultPrefix)]), "AAAA\n"...)))
+	truncated := bytes.Join(bytes.Split(ageEnc.Bytes(), []byte("\n"))[:2], []byte("\n"))
+	require.Error(t, CheckFraming(truncated))
+	garbage := "-----BEGIN AGE ENCRYPTED FILE-----\nbm90IGFuIGFnZSBmaWxl\n-----END AGE ENCRYPTED FILE-----\n"
+	require.Error(t, CheckFraming([]byte(garbage)))
+}
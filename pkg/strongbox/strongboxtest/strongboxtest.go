@@ -0,0 +1,53 @@
+// Package strongboxtest provides helpers for testing code which uses
+// strongbox.
+package strongboxtest
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// MemRepository is a strongbox.Repository of files in maps keyed by their
+// slash separated path relative to the root of the repository.
+type MemRepository struct {
+	WorkTree map[string]string
+	Head     map[string]string
+}
+
+func (r MemRepository) ReadFile(name string) ([]byte, bool, error) {
+	content, ok := r.WorkTree[filepath.ToSlash(name)]
+	return []byte(content), ok, nil
+}
+
+func (r MemRepository) ReadFileAtHEAD(name string) ([]byte, bool, error) {
+	content, ok := r.Head[filepath.ToSlash(name)]
+	return []byte(content), ok, nil
+}
+
+func (r MemRepository) ReadDir(name string) ([]string, bool, error) {
+	names, ok := memDir(r.WorkTree, name)
+	return names, ok, nil
+}
+
+func (r MemRepository) ReadDirAtHEAD(name string) ([]string, bool, error) {
+	names, ok := memDir(r.Head, name)
+	return names, ok, nil
+}
+
+// memDir returns the names of the files of directory name in files
+func memDir(files map[string]string, name string) ([]string, bool) {
+	prefix := filepath.ToSlash(name) + "/"
+	var names []string
+	found := false
+	for file := range files {
+		if rest, ok := strings.CutPrefix(file, prefix); ok {
+			found = true
+			if !strings.Contains(rest, "/") {
+				names = append(names, rest)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names, found
+}
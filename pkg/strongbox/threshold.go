@@ -0,0 +1,242 @@
+package strongbox
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// ThresholdDirective in a recipient file requires k of its recipients to
+// cooperate to decrypt a file, `@threshold k`. The file key is split with
+// Shamir's secret sharing and each share is encrypted for one recipient. It
+// can't be combined with PassphraseDirective.
+const ThresholdDirective = "@threshold"
+
+// thresholdStanzaType is the type of the stanzas holding the shares, the
+// arguments are k, the x coordinate of the share and the type and arguments
+// of the stanza of the recipient
+const thresholdStanzaType = "strongbox-threshold"
+
+// ThresholdError is returned when fewer shares than required could be
+// decrypted
+type ThresholdError struct {
+	Shares    int
+	Threshold int
+	// Err is the first error of an identity, if any
+	Err error
+}
+
+func (e *ThresholdError) Error() string {
+	msg := fmt.Sprintf("only %d of the %d required threshold shares could be decrypted", e.Shares, e.Threshold)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ThresholdError) Unwrap() error {
+	return e.Err
+}
+
+// thresholdRecipient splits the file key in a share for each of recipients,
+// k of which are required to decrypt
+type thresholdRecipient struct {
+	k          int
+	recipients []Recipient
+}
+
+// newThresholdRecipient returns the recipient of a recipient file with
+// ThresholdDirective, its key lists k and the keys of recipients so changes
+// to either re-encrypt files
+func newThresholdRecipient(k int, recipients []Recipient) (Recipient, error) {
+	if k < 1 || k > len(recipients) {
+		return Recipient{}, fmt.Errorf("threshold %d must be between 1 and the %d recipients", k, len(recipients))
+	}
+	if len(recipients) > 255 {
+		return Recipient{}, errors.New("threshold recipients are limited to 255")
+	}
+	names := make([]string, len(recipients))
+	for i, r := range recipients {
+		names[i] = r.String()
+	}
+	return Recipient{
+		Recipient: thresholdRecipient{k: k, recipients: recipients},
+		Key:       fmt.Sprintf("%s %d %s", ThresholdDirective, k, strings.Join(recipientKeys(recipients), ", ")),
+		Name:      fmt.Sprintf("%d of %s", k, strings.Join(names, ", ")),
+	}, nil
+}
+
+func (r thresholdRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	shares, err := shamirSplit(fileKey, len(r.recipients), r.k)
+	if err != nil {
+		return nil, err
+	}
+	var stanzas []*age.Stanza
+	for i, recipient := range r.recipients {
+		wrapped, err := recipient.Wrap(shares[i])
+		if err != nil {
+			return nil, fmt.Errorf("share of %s: %w", recipient, err)
+		}
+		for _, s := range wrapped {
+			args := append([]string{strconv.Itoa(r.k), strconv.Itoa(i + 1), s.Type}, s.Args...)
+			stanzas = append(stanzas, &age.Stanza{Type: thresholdStanzaType, Args: args, Body: s.Body})
+		}
+	}
+	return stanzas, nil
+}
+
+// NewThresholdIdentity returns an identity which decrypts files encrypted for
+// a recipient file with ThresholdDirective, each of identities decrypts the
+// shares it can. A *ThresholdError is returned if there aren't enough.
+func NewThresholdIdentity(identities []age.Identity) age.Identity {
+	return thresholdIdentity{identities: identities}
+}
+
+type thresholdIdentity struct {
+	identities []age.Identity
+}
+
+func (i thresholdIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	k := 0
+	sharesOf := map[byte][]*age.Stanza{}
+	for _, s := range stanzas {
+		if s.Type != thresholdStanzaType {
+			continue
+		}
+		if len(s.Args) < 3 {
+			return nil, errors.New("malformed threshold stanza")
+		}
+		sk, err := strconv.Atoi(s.Args[0])
+		if err != nil || sk < 1 || (k != 0 && sk != k) {
+			return nil, errors.New("malformed threshold stanza")
+		}
+		k = sk
+		x, err := strconv.ParseUint(s.Args[1], 10, 8)
+		if err != nil || x == 0 {
+			return nil, errors.New("malformed threshold stanza")
+		}
+		sharesOf[byte(x)] = append(sharesOf[byte(x)], &age.Stanza{Type: s.Args[2], Args: s.Args[3:], Body: s.Body})
+	}
+	if k == 0 {
+		return nil, age.ErrIncorrectIdentity
+	}
+
+	var firstErr error
+	shares := map[byte][]byte{}
+	xs := make([]byte, 0, len(sharesOf))
+	for x := range sharesOf {
+		xs = append(xs, x)
+	}
+	slices.Sort(xs)
+	for _, x := range xs {
+		for _, identity := range i.identities {
+			share, err := identity.Unwrap(sharesOf[x])
+			if errors.Is(err, age.ErrIncorrectIdentity) {
+				continue
+			}
+			if err != nil {
+				// another identity may hold enough shares
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			shares[x] = share
+			break
+		}
+		if len(shares) == k {
+			return shamirCombine(shares)
+		}
+	}
+	if len(shares) == 0 && firstErr == nil {
+		return nil, age.ErrIncorrectIdentity
+	}
+	return nil, &ThresholdError{Shares: len(shares), Threshold: k, Err: firstErr}
+}
+
+// isThresholdEncrypted returns true if in is an armored age file encrypted
+// for a recipient file with ThresholdDirective
+func isThresholdEncrypted(in []byte) bool {
+	return ageHeaderContains(in, thresholdStanzaType)
+}
+
+// shamirSplit splits secret in n shares, any k of which recover it. Share i
+// is the polynomial at x = i+1 over GF(2^8), byte by byte.
+func shamirSplit(secret []byte, n, k int) ([][]byte, error) {
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	coefficients := make([]byte, k)
+	for b, s := range secret {
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		coefficients[0] = s
+		for i := range shares {
+			x := byte(i + 1)
+			// Horner's method
+			var y byte
+			for c := k - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+			shares[i][b] = y
+		}
+	}
+	return shares, nil
+}
+
+// shamirCombine recovers the secret from shares, keyed by their x coordinate,
+// with Lagrange interpolation at x = 0
+func shamirCombine(shares map[byte][]byte) ([]byte, error) {
+	var secret []byte
+	for xi, yi := range shares {
+		if secret == nil {
+			secret = make([]byte, len(yi))
+		}
+		if len(yi) != len(secret) {
+			return nil, errors.New("threshold shares differ in length")
+		}
+		basis := byte(1)
+		for xj := range shares {
+			if xj != xi {
+				basis = gfMul(basis, gfDiv(xj, xj^xi))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(yi[b], basis)
+		}
+	}
+	return secret, nil
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial
+func gfMul(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 == 1 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+// gfDiv divides in GF(2^8), b must not be 0. The inverse of b is b^254.
+func gfDiv(a, b byte) byte {
+	inverse := byte(1)
+	for range 254 {
+		inverse = gfMul(inverse, b)
+	}
+	return gfMul(a, inverse)
+}
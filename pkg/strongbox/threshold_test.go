@@ -0,0 +1,101 @@
+package strongbox
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox/strongboxtest"
+)
+
+func TestShamir(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	shares, err := shamirSplit(secret, 5, 3)
+	require.NoError(t, err)
+	for _, xs := range [][]byte{{1, 2, 3}, {5, 3, 1}, {2, 4, 5}, {1, 2, 3, 4, 5}} {
+		subset := map[byte][]byte{}
+		for _, x := range xs {
+			subset[x] = shares[x-1]
+		}
+		combined, err := shamirCombine(subset)
+		require.NoError(t, err)
+		require.Equal(t, secret, combined)
+	}
+	combined, err := shamirCombine(map[byte][]byte{1: shares[0], 2: shares[1]})
+	require.NoError(t, err)
+	require.NotEqual(t, secret, combined)
+}
+
+func TestThresholdRecipient(t *testing.T) {
+	var custodians []age.Identity
+	var lines []string
+	for range 3 {
+		identity, err := age.GenerateX25519Identity()
+		require.NoError(t, err)
+		custodians = append(custodians, identity)
+		lines = append(lines, identity.Recipient().String())
+	}
+	repo := strongboxtest.MemRepository{
+		WorkTree: map[string]string{
+			"root/" + RecipientFilename: ThresholdDirective + " 2\n" + strings.Join(lines, "\n"),
+		},
+		Head: map[string]string{},
+	}
+	opts := Options{Repository: repo, Identities: custodians[:2]}
+
+	_, recipients, err := FindRecipients("root/password", opts)
+	require.NoError(t, err)
+	require.Len(t, recipients, 1)
+	require.True(t, strings.HasPrefix(recipients[0].Key, ThresholdDirective+" 2 age1"))
+
+	encrypted := clean(t, "hunter2\n", "root/password", opts)
+	require.True(t, isThresholdEncrypted([]byte(encrypted)))
+	require.Equal(t, "hunter2\n", smudge(t, encrypted, "root/password", opts))
+
+	// unchanged files aren't re-encrypted, changing the threshold does
+	repo.Head["root/password"] = encrypted
+	repo.Head["root/"+RecipientFilename] = repo.WorkTree["root/"+RecipientFilename]
+	require.Equal(t, encrypted, clean(t, "hunter2\n", "root/password", opts))
+	repo.WorkTree["root/"+RecipientFilename] = strings.Replace(repo.WorkTree["root/"+RecipientFilename], " 2\n", " 3\n", 1)
+	require.NotEqual(t, encrypted, clean(t, "hunter2\n", "root/password", opts))
+
+	decrypt := func(identities ...age.Identity) (string, error) {
+		var out bytes.Buffer
+		err := Decrypt(strings.NewReader(encrypted), &out, []age.Identity{NewThresholdIdentity(identities)}, nil)
+		return out.String(), err
+	}
+	for _, pair := range [][]age.Identity{{custodians[0], custodians[2]}, {custodians[2], custodians[1]}} {
+		plaintext, err := decrypt(pair...)
+		require.NoError(t, err)
+		require.Equal(t, "hunter2\n", plaintext)
+	}
+
+	// a single custodian
+	_, err = decrypt(custodians[1])
+	var thresholdErr *ThresholdError
+	require.True(t, errors.As(err, &thresholdErr))
+	require.Equal(t, 1, thresholdErr.Shares)
+	require.Equal(t, 2, thresholdErr.Threshold)
+	var out bytes.Buffer
+	require.Error(t, Decrypt(strings.NewReader(encrypted), &out, custodians, nil), "shares aren't file keys")
+
+	// not a custodian
+	outsider, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	_, err = decrypt(outsider)
+	var noMatch *age.NoIdentityMatchError
+	require.True(t, errors.As(err, &noMatch))
+
+	for _, content := range []string{
+		ThresholdDirective + " 4\n" + strings.Join(lines, "\n"),
+		ThresholdDirective + " two\n" + strings.Join(lines, "\n"),
+		ThresholdDirective + " 1\n" + PassphraseDirective + "\n",
+	} {
+		repo.WorkTree["root/"+RecipientFilename] = content
+		_, _, err = FindRecipients("root/password", Options{Repository: repo, Passphrase: func(string) ([]byte, error) { return nil, nil }})
+		require.Error(t, err, content)
+	}
+}
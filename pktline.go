@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// https://git-scm.com/docs/protocol-common#_pkt_line_format
+const (
+	pktLenSize = 4
+	// maximum length of a pkt-line including the length prefix
+	pktMaxLen  = 65520
+	pktMaxData = pktMaxLen - pktLenSize
+)
+
+type pktLineReader struct {
+	r *bufio.Reader
+}
+
+func newPktLineReader(r io.Reader) *pktLineReader {
+	return &pktLineReader{r: bufio.NewReader(r)}
+}
+
+// readPacket returns the payload of the next packet, flush is true if it was
+// a flush packet (`0000`)
+func (p *pktLineReader) readPacket() (data []byte, flush bool, err error) {
+	var lenHex [pktLenSize]byte
+	if _, err := io.ReadFull(p.r, lenHex[:]); err != nil {
+		return nil, false, err
+	}
+	l, err := strconv.ParseUint(string(lenHex[:]), 16, 16)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid pkt-line length %q", lenHex)
+	}
+	if l == 0 {
+		return nil, true, nil
+	}
+	if l <= pktLenSize || l > pktMaxLen {
+		return nil, false, fmt.Errorf("invalid pkt-line length %d", l)
+	}
+	data = make([]byte, l-pktLenSize)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return nil, false, err
+	}
+	return data, false, nil
+}
+
+// readText reads text lines until a flush packet, trailing LF is removed
+func (p *pktLineReader) readText() ([]string, error) {
+	var lines []string
+	for {
+		data, flush, err := p.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if flush {
+			return lines, nil
+		}
+		lines = append(lines, strings.TrimSuffix(string(data), "\n"))
+	}
+}
+
+// readContent reads binary packets until a flush packet
+func (p *pktLineReader) readContent() ([]byte, error) {
+	var content []byte
+	for {
+		data, flush, err := p.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if flush {
+			return content, nil
+		}
+		content = append(content, data...)
+	}
+}
+
+type pktLineWriter struct {
+	w *bufio.Writer
+}
+
+func newPktLineWriter(w io.Writer) *pktLineWriter {
+	return &pktLineWriter{w: bufio.NewWriter(w)}
+}
+
+func (p *pktLineWriter) writePacket(data []byte) error {
+	if len(data) == 0 || len(data) > pktMaxData {
+		return fmt.Errorf("invalid pkt-line data length %d", len(data))
+	}
+	if _, err := fmt.Fprintf(p.w, "%04x", len(data)+pktLenSize); err != nil {
+		return err
+	}
+	_, err := p.w.Write(data)
+	return err
+}
+
+func (p *pktLineWriter) writeFlush() error {
+	_, err := p.w.WriteString("0000")
+	return err
+}
+
+// writeText writes each line as a separate packet followed by a flush packet
+func (p *pktLineWriter) writeText(lines ...string) error {
+	for _, l := range lines {
+		if err := p.writePacket([]byte(l + "\n")); err != nil {
+			return err
+		}
+	}
+	return p.writeFlush()
+}
+
+// writeContent splits content into packets followed by a flush packet
+func (p *pktLineWriter) writeContent(content []byte) error {
+	for len(content) > 0 {
+		l := min(len(content), pktMaxData)
+		if err := p.writePacket(content[:l]); err != nil {
+			return err
+		}
+		content = content[l:]
+	}
+	return p.writeFlush()
+}
+
+// Flush sends buffered packets to the underlying writer
+func (p *pktLineWriter) Flush() error {
+	return p.w.Flush()
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+// reencryptEnv makes the clean filter encrypt age files again even if they
+// are unchanged since HEAD, see strongbox.Options.Reencrypt
+const reencryptEnv = "STRONGBOX_REENCRYPT"
+
+// recipientsCommand is `strongbox recipients add|remove`, it edits the
+// recipient file of a directory and re-encrypts the files it governs
+func recipientsCommand(w io.Writer, args []string) error {
+	if len(args) == 0 || (args[0] != "add" && args[0] != "remove") {
+		return errors.New("usage: strongbox recipients add|remove [-dir PATH] KEY")
+	}
+	op := args[0]
+	flags := flag.NewFlagSet("recipients "+op, flag.ContinueOnError)
+	dir := flags.String("dir", ".", "Directory whose recipient file is edited")
+	name := new(string)
+	if op == "add" {
+		name = flags.String("name", "", "Name of the recipient, written in a comment before the key")
+	}
+	// flags can be given after the key, whose fields (eg of SSH keys) don't
+	// need to be quoted
+	var fields []string
+	for rest := args[1:]; ; rest = flags.Args()[1:] {
+		if err := flags.Parse(rest); err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		fields = append(fields, flags.Arg(0))
+	}
+	key := strings.Join(fields, " ")
+	if key == "" {
+		return fmt.Errorf("usage: strongbox recipients %s [-dir PATH] KEY", op)
+	}
+
+	absDir, err := filepath.Abs(*dir)
+	if err != nil {
+		return err
+	}
+	if err := chdirTopLevel(); err != nil {
+		return err
+	}
+	if err := checkFilterConfigured(); err != nil {
+		return err
+	}
+	top, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	relDir, err := filepath.Rel(top, absDir)
+	if err != nil || !filepath.IsLocal(relDir) && relDir != "." {
+		return fmt.Errorf("%s is outside of the repository", *dir)
+	}
+
+	keyDir, err := governingDir(relDir, op == "add")
+	if err != nil {
+		return err
+	}
+	var edits []recipientEdit
+	if op == "add" {
+		edits, err = addRecipientEdits(keyDir, key, *name)
+	} else {
+		edits, err = removeRecipientEdits(keyDir, key)
+	}
+	if err != nil {
+		return err
+	}
+	// re-encrypting stages the working tree content, which must not include
+	// unrelated changes
+	governed, err := governedFiles(keyDir, true)
+	if err != nil {
+		return err
+	}
+	if err := checkUnstaged(governed); err != nil {
+		return err
+	}
+	if err := writeRecipientFiles(keyDir, edits); err != nil {
+		return err
+	}
+	var paths []string
+	for _, edit := range edits {
+		if op == "add" {
+			fmt.Fprintf(w, "added %s to %s\n", key, edit.path)
+		} else {
+			fmt.Fprintf(w, "removed %s from %s\n", key, edit.path)
+		}
+		paths = append(paths, edit.path)
+	}
+
+	return reencryptGoverned(w, keyDir, paths)
+}
+
+// governingDir returns the directory of the recipient file, or directory,
+// which governs dir. If there is none and create is set, it's dir.
+func governingDir(dir string, create bool) (string, error) {
+	keyFile, _, err := strongbox.FindKeyFile(gitRepository{worktree: true}, filepath.Join(dir, strongbox.RecipientFilename))
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case filepath.Base(keyFile) == strongbox.KeyIDFilename:
+		return "", fmt.Errorf("%s is encrypted with the siv key of %s, not for recipients", dir, keyFile)
+	case keyFile != "":
+		return filepath.Dir(keyFile), nil
+	case create:
+		return dir, nil
+	}
+	return "", fmt.Errorf("no %s governs %s", strongbox.RecipientFilename, dir)
+}
+
+// recipientEdit is the new content of a recipient file, it's removed if edited
+// is nil
+type recipientEdit struct {
+	path             string
+	previous, edited []byte
+}
+
+// recipientFiles returns the recipient file and the files of the recipient
+// directory in keyDir, those which exist
+func recipientFiles(keyDir string) ([]string, error) {
+	var files []string
+	if _, err := os.Stat(filepath.Join(keyDir, strongbox.RecipientFilename)); err == nil {
+		files = append(files, filepath.Join(keyDir, strongbox.RecipientFilename))
+	}
+	names, _, err := readRepoDir(filepath.Join(keyDir, strongbox.RecipientDirname), "", true)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, ".") {
+			files = append(files, filepath.Join(keyDir, strongbox.RecipientDirname, name))
+		}
+	}
+	return files, nil
+}
+
+// addRecipientEdits adds key to the recipient file of keyDir. If there is a
+// recipient directory it's added to the file of the directory named after
+// name, unless name is empty.
+func addRecipientEdits(keyDir, key, name string) ([]recipientEdit, error) {
+	path := filepath.Join(keyDir, strongbox.RecipientFilename)
+	recipientDir := filepath.Join(keyDir, strongbox.RecipientDirname)
+	if fi, err := os.Stat(recipientDir); err == nil && fi.IsDir() {
+		_, noFile := os.Stat(path)
+		switch {
+		case name != "":
+			if name != filepath.Base(name) || !filepath.IsLocal(name) || strings.HasPrefix(name, ".") {
+				return nil, fmt.Errorf("invalid name %q, it's the name of the file in %s", name, recipientDir)
+			}
+			// the file names its recipients
+			path, name = filepath.Join(recipientDir, name+".pub"), ""
+		case noFile != nil:
+			return nil, fmt.Errorf("-name is required to add a recipient to %s", recipientDir)
+		}
+	}
+
+	files, err := recipientFiles(keyDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file == path {
+			continue
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		// only checks key isn't a recipient already
+		if _, err := strongbox.AddRecipient(content, key, ""); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	edited, err := strongbox.AddRecipient(content, key, name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return []recipientEdit{{path: path, previous: content, edited: edited}}, nil
+}
+
+// removeRecipientEdits removes key from the recipient files of keyDir, files
+// of the recipient directory left without recipients are removed
+func removeRecipientEdits(keyDir, key string) ([]recipientEdit, error) {
+	files, err := recipientFiles(keyDir)
+	if err != nil {
+		return nil, err
+	}
+	var edits []recipientEdit
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		edited, err := strongbox.RemoveRecipient(content, key)
+		if errors.Is(err, strongbox.ErrNotRecipient) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if filepath.Base(file) != strongbox.RecipientFilename && !hasRecipientLines(edited) {
+			edited = nil
+		}
+		edits = append(edits, recipientEdit{path: file, previous: content, edited: edited})
+	}
+	if len(edits) == 0 {
+		return nil, fmt.Errorf("%s is not a recipient in %s", key, keyDir)
+	}
+	return edits, nil
+}
+
+// hasRecipientLines returns true if content has lines other than comments
+func hasRecipientLines(content []byte) bool {
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRecipientFiles applies edits to the recipient files of keyDir, which
+// are checked first. The previous content is restored if the recipients can't
+// be loaded, eg if none are left, or violate the policy.
+func writeRecipientFiles(keyDir string, edits []recipientEdit) error {
+	restore := func(applied []recipientEdit) error {
+		for _, edit := range applied {
+			var err error
+			if edit.previous == nil {
+				err = os.Remove(edit.path)
+			} else {
+				err = writeRecipientFile(edit.path, edit.previous)
+			}
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("unable to restore %s: %w", edit.path, err)
+			}
+		}
+		return nil
+	}
+	for i, edit := range edits {
+		var err error
+		if edit.edited == nil {
+			err = os.Remove(edit.path)
+		} else {
+			err = writeRecipientFile(edit.path, edit.edited)
+		}
+		if err != nil {
+			if restoreErr := restore(edits[:i]); restoreErr != nil {
+				return fmt.Errorf("%w, %v", err, restoreErr)
+			}
+			return err
+		}
+	}
+	if err := checkRecipients(keyDir); err != nil {
+		if restoreErr := restore(edits); restoreErr != nil {
+			return fmt.Errorf("%w, %v", err, restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkRecipients returns an error if the recipients of keyDir can't be
+// loaded or violate the policy of the repository
+func checkRecipients(keyDir string) error {
+	_, recipients, err := strongbox.FindRecipients(filepath.Join(keyDir, strongbox.RecipientFilename), cleanOptions())
+	if err != nil {
+		return err
+	}
+	policy, err := strongbox.FindPolicy(gitRepository{worktree: true})
+	if err != nil {
+		return err
+	}
+	backend := strongbox.BackendAge
+	if len(recipients) == 0 {
+		backend = strongbox.BackendNone
+	}
+	if err := policy.Check(backend, recipients); err != nil {
+		return fmt.Errorf("%s: %w (%s)", keyDir, err, strongbox.PolicyFilename)
+	}
+	return nil
+}
+
+// writeRecipientFile replaces the content of a recipient file atomically,
+// keeping its mode
+func writeRecipientFile(name string, content []byte) error {
+	mode := os.FileMode(0o644)
+	if fi, err := os.Stat(name); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".strongbox_recipient-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// reencryptGoverned stages the edited recipient files and the tracked files
+// governed by the recipients of keyDir, or inheriting them, encrypted again
+// for their current recipients. Files left encrypted in the working tree
+// can't be re-encrypted, they are reported.
+func reencryptGoverned(w io.Writer, keyDir string, recipientFiles []string) error {
+	args := append([]string{"add", "--"}, recipientFiles...)
+	if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("git add %s failed: %s", strings.Join(recipientFiles, " "), out)
+	}
+
+	files, err := governedFiles(keyDir, false)
+	if err != nil {
+		return err
+	}
+	var governed []string
+	var left int
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			// deleted, nothing to encrypt
+			continue
+		} else if err != nil {
+			return err
+		}
+		if strongbox.IsEncrypted(content) {
+			fmt.Fprintf(w, "left encrypted, can't re-encrypt: %s\n", file)
+			left++
+			continue
+		}
+		governed = append(governed, file)
+	}
+
+	if len(governed) > 0 {
+		// --renormalize runs the clean filter even if the files didn't
+		// change, unlike `git add` and `git update-index`
+		cmd := exec.Command("git", "add", "--renormalize", "--pathspec-from-file=-", "--pathspec-file-nul")
+		cmd.Env = append(os.Environ(), reencryptEnv+"=1")
+		cmd.Stdin = strings.NewReader(strings.Join(governed, "\x00") + "\x00")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git add --renormalize failed: %s", out)
+		}
+		for _, file := range governed {
+			fmt.Fprintf(w, "re-encrypted: %s\n", file)
+		}
+	}
+	if left > 0 {
+		return fmt.Errorf("%d file(s) left encrypted weren't re-encrypted, run `strongbox refresh` once they can be decrypted", left)
+	}
+	return nil
+}
+
+// governedFiles returns the tracked strongbox files whose recipients are
+// those of keyDir, or inherit them. Before keyDir has a recipient file the
+// files under it governed from above are returned, they will be once it's
+// created. Files whose recipients can't be loaded are an error, unless
+// lenient is set and they are returned. Recipient, key-id and policy files
+// are skipped even if the filter applies to them.
+func governedFiles(keyDir string, lenient bool) ([]string, error) {
+	files, err := strongboxFiles()
+	if err != nil {
+		return nil, err
+	}
+	keyDir = filepath.Clean(keyDir)
+	var governed []string
+	for _, file := range files {
+		if !withinDir(file, keyDir) || isKeyFile(file) {
+			continue
+		}
+		keyFile, _, err := strongbox.FindKeyFile(gitRepository{worktree: true}, file)
+		if err != nil {
+			return nil, err
+		}
+		if keyFile == "" || filepath.Base(keyFile) == strongbox.KeyIDFilename {
+			continue
+		}
+		// files of sub directories inheriting the recipients are governed too
+		chain, err := strongbox.RecipientChain(file, cleanOptions())
+		if err != nil && !lenient {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if err != nil || slices.ContainsFunc(chain, func(path string) bool {
+			dir := filepath.Dir(path)
+			return dir == keyDir || !withinDir(dir, keyDir)
+		}) {
+			governed = append(governed, file)
+		}
+	}
+	return governed, nil
+}
+
+// withinDir returns true if path is dir or below it
+func withinDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// isKeyFile returns true for recipient, key-id and policy files, which are
+// never encrypted
+func isKeyFile(path string) bool {
+	switch filepath.Base(path) {
+	case strongbox.RecipientFilename, strongbox.KeyIDFilename, strongbox.PolicyFilename:
+		return true
+	}
+	return filepath.Base(filepath.Dir(path)) == strongbox.RecipientDirname
+}
+
+// checkUnstaged returns an error listing the files whose working tree content
+// differs from the staged version, re-encrypting them would stage it. Files
+// whose staged version can't be decrypted are compared by git.
+func checkUnstaged(files []string) error {
+	// cat-file reads the index once, restart it in case it changed
+	catFile.Close()
+	opts := options("")
+	opts.LeftEncrypted = func(filename string, err error) error {
+		return err
+	}
+	var unstaged, undecryptable []string
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if strongbox.IsEncrypted(content) {
+			// left encrypted, it isn't re-encrypted
+			continue
+		}
+		blob, ok, err := catFile.Object(":" + file)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		var staged bytes.Buffer
+		if err := strongbox.Smudge(bytes.NewReader(blob), &staged, file, opts); err != nil {
+			undecryptable = append(undecryptable, file)
+			continue
+		}
+		if !bytes.Equal(content, staged.Bytes()) {
+			unstaged = append(unstaged, file)
+		}
+	}
+	if len(undecryptable) > 0 {
+		cmd := exec.Command("git", append([]string{"diff-files", "--name-only", "-z", "--"}, undecryptable...)...)
+		out, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("git diff-files failed: %w", err)
+		}
+		for _, file := range strings.Split(string(out), "\x00") {
+			if file != "" {
+				unstaged = append(unstaged, file)
+			}
+		}
+	}
+	if len(unstaged) > 0 {
+		return fmt.Errorf("re-encrypting would stage the unstaged changes of %s, stage or stash them first", strings.Join(unstaged, ", "))
+	}
+	return nil
+}
+
+// checkFilterConfigured returns an error if git isn't configured to run the
+// strongbox filter, files would be staged in plaintext
+func checkFilterConfigured() error {
+	for _, key := range []string{"filter.strongbox.process", "filter.strongbox.clean"} {
+		out, err := exec.Command("git", "config", "--get", key).Output()
+		if err == nil && len(bytes.TrimSpace(out)) > 0 {
+			return nil
+		}
+	}
+	return errors.New("the strongbox filter isn't configured in git, run `strongbox -git-config` first")
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+// setupFilterRepo creates a repository using the strongbox filter, whose
+// identity file holds identity, with files committed
+func setupFilterRepo(t *testing.T, identity *age.X25519Identity, files map[string]string) {
+	t.Helper()
+	ensureStrongboxBuilt(t)
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	binary := filepath.Join(cwd, _STRONGBOX_TEST_BINARY)
+
+	home := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(home, defaultIdentityFilename), []byte(identity.String()+"\n"), 0o600))
+	t.Setenv("STRONGBOX_HOME", home)
+	// the command runs in process too
+	previousIdentityFilename := identityFilename
+	identityFilename = filepath.Join(home, defaultIdentityFilename)
+	identitiesOnce = sync.Once{}
+	t.Cleanup(func() {
+		identityFilename = previousIdentityFilename
+		identitiesOnce = sync.Once{}
+	})
+
+	setupTestRepo(t)
+	mustGit(t, "config", "filter.strongbox.clean", binary+" -clean %f")
+	mustGit(t, "config", "filter.strongbox.smudge", binary+" -smudge %f")
+	mustGit(t, "config", "filter.strongbox.required", "true")
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0o755))
+		require.NoError(t, os.WriteFile(name, []byte(content), 0o644))
+		// files modified in the same second as the index are filtered again
+		// by git status, which encrypts them differently
+		require.NoError(t, os.Chtimes(name, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+	}
+	mustGit(t, "add", ".")
+	mustGit(t, "commit", "--quiet", "--message", "add secrets")
+}
+
+// decryptIndex decrypts the staged version of file with identity
+func decryptIndex(t *testing.T, file string, identity age.Identity) (string, error) {
+	t.Helper()
+	// cat-file reads the index once, restart it to see what was staged
+	catFile.Close()
+	blob, ok, err := catFile.Object(":" + file)
+	require.NoError(t, err)
+	require.True(t, ok)
+	var out bytes.Buffer
+	err = strongbox.Decrypt(bytes.NewReader(blob), &out, []age.Identity{identity}, nil)
+	return out.String(), err
+}
+
+func TestRecipientsCommand(t *testing.T) {
+	alice, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	bob, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	files := map[string]string{
+		".gitattributes":                         "secrets/** filter=strongbox\n**/.strongbox_recipient !filter\n",
+		"secrets/" + strongbox.RecipientFilename: alice.Recipient().String() + "\n",
+		"secrets/a":                              "secret a\n",
+		"secrets/sub/b":                          "secret b\n",
+		"public":                                 "public\n",
+	}
+	setupFilterRepo(t, alice, files)
+
+	_, err = decryptIndex(t, "secrets/a", bob)
+	require.Error(t, err)
+
+	// flags after the key, from a sub directory
+	require.NoError(t, os.Chdir("secrets/sub"))
+	var out bytes.Buffer
+	require.NoError(t, recipientsCommand(&out, []string{"add", bob.Recipient().String(), "--name", "bob", "--dir", "."}))
+	require.Contains(t, out.String(), "added "+bob.Recipient().String()+" to secrets/"+strongbox.RecipientFilename)
+	require.Contains(t, out.String(), "re-encrypted: secrets/a\n")
+	require.Contains(t, out.String(), "re-encrypted: secrets/sub/b\n")
+	require.Equal(t, alice.Recipient().String()+"\n# name: bob\n"+bob.Recipient().String()+"\n", string(mustReadFile(t, "secrets/"+strongbox.RecipientFilename)))
+	for _, file := range []string{"secrets/a", "secrets/sub/b"} {
+		plaintext, err := decryptIndex(t, file, bob)
+		require.NoError(t, err)
+		require.Equal(t, files[file], plaintext)
+	}
+	status, err := runCmd("git", "status", "--porcelain")
+	require.NoError(t, err)
+	require.Equal(t, "M  secrets/"+strongbox.RecipientFilename+"\nM  secrets/a\nM  secrets/sub/b\n", status)
+	mustGit(t, "commit", "--quiet", "--message", "add bob")
+
+	out.Reset()
+	require.NoError(t, recipientsCommand(&out, []string{"remove", "-dir", "secrets", alice.Recipient().String()}))
+	_, err = decryptIndex(t, "secrets/a", alice)
+	require.Error(t, err, "removed recipients can't decrypt new versions")
+	plaintext, err := decryptIndex(t, "secrets/a", bob)
+	require.NoError(t, err)
+	require.Equal(t, "secret a\n", plaintext)
+
+	// the last recipient can't be removed
+	recipientFile := string(mustReadFile(t, "secrets/"+strongbox.RecipientFilename))
+	err = recipientsCommand(&out, []string{"remove", "-dir", "secrets", bob.Recipient().String()})
+	require.Error(t, err)
+	require.Equal(t, recipientFile, string(mustReadFile(t, "secrets/"+strongbox.RecipientFilename)))
+	require.Error(t, recipientsCommand(&out, []string{"add", "-dir", "secrets", "age1nope"}))
+
+	// files left encrypted are reported
+	require.NoError(t, os.WriteFile("secrets/a", ageEncryptTest(t, "secret a\n", alice.Recipient()), 0o644))
+	out.Reset()
+	err = recipientsCommand(&out, []string{"add", "-dir", "secrets", alice.Recipient().String()})
+	require.Error(t, err)
+	require.Contains(t, out.String(), "left encrypted, can't re-encrypt: secrets/a\n")
+	require.Contains(t, out.String(), "re-encrypted: secrets/sub/b\n")
+	require.False(t, strings.Contains(out.String(), "public"))
+}
+
+func TestRecipientsCommandDir(t *testing.T) {
+	alice, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	bob, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipientDir := filepath.Join("secrets", strongbox.RecipientDirname)
+	setupFilterRepo(t, alice, map[string]string{
+		".gitattributes":                            "secrets/* filter=strongbox\nsecrets/ci/* filter=strongbox\n**/.strongbox_recipient !filter\n",
+		filepath.Join(recipientDir, "alice.pub"):    alice.Recipient().String() + "\n",
+		"secrets/a":                                 "secret a\n",
+		"secrets/ci/" + strongbox.RecipientFilename: strongbox.InheritDirective + "\n",
+		"secrets/ci/token":                          "token\n",
+	})
+
+	var out bytes.Buffer
+	err = recipientsCommand(&out, []string{"add", "-dir", "secrets", bob.Recipient().String()})
+	require.Error(t, err, "the name of the file is required")
+	require.NoError(t, recipientsCommand(&out, []string{"add", "-dir", "secrets", "-name", "bob", bob.Recipient().String()}))
+	require.Equal(t, bob.Recipient().String()+"\n", string(mustReadFile(t, filepath.Join(recipientDir, "bob.pub"))))
+	plaintext, err := decryptIndex(t, "secrets/a", bob)
+	require.NoError(t, err)
+	require.Equal(t, "secret a\n", plaintext)
+	// files inheriting the recipients are re-encrypted too
+	plaintext, err = decryptIndex(t, "secrets/ci/token", bob)
+	require.NoError(t, err)
+	require.Equal(t, "token\n", plaintext)
+	err = recipientsCommand(&out, []string{"add", "-dir", "secrets", "-name", "robert", bob.Recipient().String()})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "already a recipient")
+	require.Contains(t, out.String(), "re-encrypted: secrets/a\n")
+
+	status, err := runCmd("git", "status", "--porcelain")
+	require.NoError(t, err)
+	require.Equal(t, "A  "+filepath.ToSlash(recipientDir)+"/bob.pub\nM  secrets/a\nM  secrets/ci/token\n", status)
+	mustGit(t, "commit", "--quiet", "--message", "add bob")
+
+	// the file of a removed recipient is removed
+	require.NoError(t, recipientsCommand(&out, []string{"remove", "-dir", "secrets", alice.Recipient().String()}))
+	_, err = os.Stat(filepath.Join(recipientDir, "alice.pub"))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = decryptIndex(t, "secrets/a", alice)
+	require.Error(t, err)
+	status, err = runCmd("git", "status", "--porcelain")
+	require.NoError(t, err)
+	require.Equal(t, "D  "+filepath.ToSlash(recipientDir)+"/alice.pub\nM  secrets/a\nM  secrets/ci/token\n", status)
+
+	err = recipientsCommand(&out, []string{"remove", "-dir", "secrets", bob.Recipient().String()})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no recipients found")
+	require.Equal(t, bob.Recipient().String()+"\n", string(mustReadFile(t, filepath.Join(recipientDir, "bob.pub"))))
+
+	// recipients violating the policy aren't added
+	require.NoError(t, os.WriteFile(strongbox.PolicyFilename, []byte("revoked_keys: ["+alice.Recipient().String()+"]\n"), 0o644))
+	err = recipientsCommand(&out, []string{"add", "-dir", "secrets", "-name", "alice", alice.Recipient().String()})
+	require.Error(t, err)
+	require.ErrorIs(t, err, strongbox.ErrPolicyViolation)
+	_, err = os.Stat(filepath.Join(recipientDir, "alice.pub"))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestRecipientsCommandGovernedFiles(t *testing.T) {
+	alice, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	bob, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	// the recipient files match the filter pattern too
+	setupFilterRepo(t, alice, map[string]string{
+		".gitattributes":                                       "secrets/** filter=strongbox\n",
+		"secrets/" + strongbox.RecipientFilename:               alice.Recipient().String() + "\n",
+		"secrets/" + strongbox.RecipientDirname + "/carol.pub": alice.Recipient().String() + "\n",
+		"secrets/a": "secret a\n",
+	})
+
+	// unstaged changes aren't staged by re-encrypting
+	require.NoError(t, os.WriteFile("secrets/a", []byte("unstaged\n"), 0o644))
+	var out bytes.Buffer
+	err = recipientsCommand(&out, []string{"add", "-dir", "secrets", bob.Recipient().String()})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unstaged changes of secrets/a")
+	require.Equal(t, alice.Recipient().String()+"\n", string(mustReadFile(t, "secrets/"+strongbox.RecipientFilename)))
+	plaintext, err := decryptIndex(t, "secrets/a", alice)
+	require.NoError(t, err)
+	require.Equal(t, "secret a\n", plaintext)
+
+	mustGit(t, "add", "secrets/a")
+	require.NoError(t, recipientsCommand(&out, []string{"add", "-dir", "secrets", bob.Recipient().String()}))
+	require.Equal(t, "added "+bob.Recipient().String()+" to secrets/"+strongbox.RecipientFilename+"\nre-encrypted: secrets/a\n", out.String())
+	plaintext, err = decryptIndex(t, "secrets/a", bob)
+	require.NoError(t, err)
+	require.Equal(t, "unstaged\n", plaintext)
+}
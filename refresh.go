@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+// refresh decrypts tracked strongbox files which were left encrypted in the
+// working tree, eg because the identity or key was added after checkout, and
+// writes a line per file to w. It returns an error if some files still can't
+// be decrypted, those are recorded in the state file. Only the stat info of
+// the index is refreshed, files which clean wouldn't give back the staged blob
+// for, eg because their recipients changed since, are reported and not
+// staged.
+func refresh(w io.Writer) error {
+	if err := chdirTopLevel(); err != nil {
+		return err
+	}
+	files, err := strongboxFiles()
+	if err != nil {
+		return err
+	}
+
+	var decrypted []string
+	var left []leftEncryptedEntry
+	for _, file := range files {
+		ok, err := refreshFile(file)
+		if err != nil {
+			fmt.Fprintf(w, "left encrypted: %s: %s\n", file, err)
+			left = append(left, newLeftEncryptedEntry(file, err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := cleansToIndex(file); err != nil {
+			fmt.Fprintf(w, "decrypted, not staged: %s: %s\n", file, err)
+			continue
+		}
+		fmt.Fprintf(w, "decrypted: %s\n", file)
+		decrypted = append(decrypted, file)
+	}
+
+	if len(decrypted) > 0 {
+		// the size changed so `git update-index --refresh` would consider
+		// the files modified without cleaning them, re-add them instead.
+		// They were checked to clean to the staged blob.
+		cmd := exec.Command("git", "update-index", "-z", "--stdin")
+		cmd.Stdin = strings.NewReader(strings.Join(decrypted, "\x00") + "\x00")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git update-index failed: %s", out)
+		}
+	}
+	if err := replaceLeftEncrypted(left); err != nil {
+		return fmt.Errorf("unable to update %s: %w", leftEncryptedFilename, err)
+	}
+	if len(left) > 0 {
+		return fmt.Errorf("%d file(s) left encrypted", len(left))
+	}
+	return nil
+}
+
+// refreshFile decrypts file in place if its content is still encrypted, ok is
+// false if there was nothing to do
+func refreshFile(file string) (ok bool, err error) {
+	fi, err := os.Lstat(file)
+	if err != nil || !fi.Mode().IsRegular() {
+		// deleted or not a regular file, nothing to decrypt
+		return false, nil
+	}
+	in, err := os.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	if !strongbox.IsEncrypted(in) {
+		return false, nil
+	}
+
+	opts := options("")
+	opts.LeftEncrypted = func(filename string, err error) error {
+		return explainDecryptError(err)
+	}
+	var out bytes.Buffer
+	if err := strongbox.Smudge(bytes.NewReader(in), &out, file, opts); err != nil {
+		return false, err
+	}
+
+	// write next to the file and rename so it's never left half written
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".strongbox-refresh-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out.Bytes()); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(tmp.Name(), fi.Mode().Perm()); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), file)
+}
+
+// cleansToIndex returns an error if cleaning the plaintext of file doesn't
+// give back its staged blob, re-adding it would stage new content
+func cleansToIndex(file string) error {
+	in, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var cleaned bytes.Buffer
+	if err := strongbox.Clean(bytes.NewReader(in), &cleaned, file, cleanOptions()); err != nil {
+		return err
+	}
+	staged, ok, err := catFile.Object(":" + file)
+	if err != nil {
+		return err
+	}
+	if !ok || !bytes.Equal(cleaned.Bytes(), staged) {
+		return errors.New("it would be encrypted differently than the staged version, eg for changed recipients, run `git add` to stage it")
+	}
+	return nil
+}
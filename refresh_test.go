@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+func TestRefresh(t *testing.T) {
+	useTestIdentities(t)
+	key, keyID := useTestKeyRing(t)
+	unknown, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	ageEnc := ageEncryptTest(t, "age-secret\n", testRecipients(t)...)
+	unknownEnc := ageEncryptTest(t, "unknown-secret\n", unknown.Recipient())
+	sivEnc := sivEncryptTest(t, "siv-secret\n", key)
+	recipients := mustReadFile(t, filepath.Join("testdata", strongbox.RecipientFilename))
+
+	repoDir := setupTestRepo(t)
+	t.Setenv("STRONGBOX_STRICT", "false")
+	addTestFiles(t, map[string][]byte{
+		".gitattributes":               []byte("secrets/** filter=strongbox\n"),
+		"secrets/.strongbox_recipient": recipients,
+		"secrets/age":                  ageEnc,
+		"secrets/unknown":              unknownEnc,
+		"secrets/siv/.strongbox-keyid": []byte(keyID + "\n"),
+		"secrets/siv/secret":           sivEnc,
+		"not-filtered":                 ageEnc,
+	})
+	mustGit(t, "commit", "--quiet", "--message", "add secrets")
+
+	require.NoError(t, os.Chdir("secrets"))
+	var out bytes.Buffer
+	err = refresh(&out)
+	require.Error(t, err, "file encrypted for unknown identity should be reported")
+	require.Contains(t, out.String(), "decrypted: secrets/age\n")
+	require.Contains(t, out.String(), "decrypted: secrets/siv/secret\n")
+	require.Contains(t, out.String(), "left encrypted: secrets/unknown: ")
+	require.NotContains(t, out.String(), "not-filtered")
+
+	read := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(repoDir, name))
+		require.NoError(t, err)
+		return string(b)
+	}
+	require.Equal(t, "age-secret\n", read("secrets/age"))
+	require.Equal(t, "siv-secret\n", read("secrets/siv/secret"))
+	require.Equal(t, string(unknownEnc), read("secrets/unknown"))
+	require.Equal(t, string(ageEnc), read("not-filtered"))
+	fi, err := os.Stat(filepath.Join(repoDir, "secrets/age"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	state := read(filepath.Join(".git", leftEncryptedFilename))
+	require.Equal(t, 1, strings.Count(state, "\n"))
+	require.Contains(t, state, `"path":"secrets/unknown"`)
+
+	// nothing left to do once the identity is known
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "secrets/unknown"), []byte("unknown-secret\n"), 0o600))
+	out.Reset()
+	require.NoError(t, refresh(&out))
+	require.Empty(t, out.String())
+	require.NoFileExists(t, filepath.Join(repoDir, ".git", leftEncryptedFilename))
+}
+
+func TestRefreshRecipientsChanged(t *testing.T) {
+	alice, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	bob, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	setupFilterRepo(t, alice, map[string]string{
+		".gitattributes":                         "secrets/** filter=strongbox\n**/.strongbox_recipient !filter\n",
+		"secrets/" + strongbox.RecipientFilename: alice.Recipient().String() + "\n",
+		"secrets/a":                              "secret a\n",
+	})
+	// left encrypted on checkout, then the recipients changed
+	staged, err := runCmd("git", "rev-parse", ":secrets/a")
+	require.NoError(t, err)
+	blob, err := runCmd("git", "cat-file", "blob", ":secrets/a")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile("secrets/a", []byte(blob), 0o644))
+	require.NoError(t, os.WriteFile("secrets/"+strongbox.RecipientFilename, []byte(alice.Recipient().String()+"\n"+bob.Recipient().String()+"\n"), 0o644))
+
+	var out bytes.Buffer
+	require.NoError(t, refresh(&out))
+	require.Contains(t, out.String(), "decrypted, not staged: secrets/a: ")
+	require.Equal(t, "secret a\n", string(mustReadFile(t, "secrets/a")))
+	stagedAfter, err := runCmd("git", "rev-parse", ":secrets/a")
+	require.NoError(t, err)
+	require.Equal(t, staged, stagedAfter, "new content shouldn't be staged")
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+// leftEncryptedFilename is the state file, relative to the git directory,
+// where smudge records files it left encrypted. It has one JSON object per
+// line and file, see leftEncryptedEntry.
+const leftEncryptedFilename = "strongbox/left-encrypted"
+
+type leftEncryptedEntry struct {
+	Path   string    `json:"path"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+var (
+	strictOnce sync.Once
+	strict     bool
+)
+
+// strictMode returns true if smudge should fail instead of leaving files
+// encrypted. It's enabled by $STRONGBOX_STRICT or `git config
+// strongbox.strict`, the environment takes precedence.
+func strictMode() bool {
+	strictOnce.Do(func() {
+		if v, ok := os.LookupEnv("STRONGBOX_STRICT"); ok {
+			var err error
+			if strict, err = strconv.ParseBool(v); err != nil {
+				log.Printf("invalid STRONGBOX_STRICT value %q, using strict mode", v)
+				strict = true
+			}
+			return
+		}
+		out, err := exec.Command("git", "config", "--type=bool", "--get", "strongbox.strict").Output()
+		strict = err == nil && strings.TrimSpace(string(out)) == "true"
+	})
+	return strict
+}
+
+// leftEncrypted is called for every file smudge couldn't decrypt. In strict
+// mode it fails the smudge, otherwise the file is recorded in the state file
+// and left encrypted.
+func leftEncrypted(filename string, err error) error {
+	err = explainDecryptError(err)
+	if err := leaveEncrypted(filename, err); err != nil {
+		return err
+	}
+	if err := recordLeftEncrypted(filename, err); err != nil {
+		log.Printf("unable to record %s as left encrypted: %s", filename, err)
+	}
+	return nil
+}
+
+// leaveEncrypted fails in strict mode, otherwise it logs unexpected reasons
+// for leaving filename encrypted
+func leaveEncrypted(filename string, err error) error {
+	if strictMode() {
+		return fmt.Errorf("strict mode: unable to decrypt %s: %w", filename, err)
+	}
+	// missing identity or key is expected for files we don't have access to
+	var noMatch *age.NoIdentityMatchError
+	if !errors.Is(err, strongbox.ErrNoIdentities) && !errors.Is(err, strongbox.ErrKeyNotFound) && !errors.As(err, &noMatch) {
+		log.Println(err)
+	}
+	return nil
+}
+
+// explainDecryptError adds why identities couldn't be loaded to
+// strongbox.ErrNoIdentities and how to gather more threshold shares
+func explainDecryptError(err error) error {
+	var thresholdErr *strongbox.ThresholdError
+	if errors.As(err, &thresholdErr) {
+		return fmt.Errorf("%w, use `strongbox unlock-threshold` to combine the shares of other custodians", err)
+	}
+	if !errors.Is(err, strongbox.ErrNoIdentities) {
+		return err
+	}
+	if _, idErr := loadIdentities(); idErr != nil {
+		return fmt.Errorf("%w: unable to load %s: %v", err, identitySource, idErr)
+	}
+	return fmt.Errorf("%w in %s", err, identitySource)
+}
+
+// recordLeftEncrypted records filename in the state file, replacing its
+// previous entry
+func recordLeftEncrypted(filename string, reason error) error {
+	entry := newLeftEncryptedEntry(filename, reason)
+	return editLeftEncrypted(func(entries []leftEncryptedEntry) []leftEncryptedEntry {
+		return append(withoutLeftEncrypted(entries, entry.Path), entry)
+	})
+}
+
+// clearLeftEncrypted removes the entry of filename from the state file, once
+// it has been decrypted
+func clearLeftEncrypted(filename string) error {
+	dir, err := gitDir()
+	if err != nil {
+		// not run by git, there's no state file
+		return nil
+	}
+	// the common case of nothing left encrypted doesn't need the lock
+	if _, err := os.Stat(filepath.Join(dir, leftEncryptedFilename)); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	path := filepath.ToSlash(filename)
+	return editLeftEncrypted(func(entries []leftEncryptedEntry) []leftEncryptedEntry {
+		return withoutLeftEncrypted(entries, path)
+	})
+}
+
+// replaceLeftEncrypted replaces the content of the state file with entries,
+// the file is removed if there are none
+func replaceLeftEncrypted(entries []leftEncryptedEntry) error {
+	return editLeftEncrypted(func([]leftEncryptedEntry) []leftEncryptedEntry {
+		return entries
+	})
+}
+
+func newLeftEncryptedEntry(filename string, reason error) leftEncryptedEntry {
+	return leftEncryptedEntry{Path: filepath.ToSlash(filename), Reason: reason.Error(), Time: time.Now().UTC()}
+}
+
+func withoutLeftEncrypted(entries []leftEncryptedEntry, path string) []leftEncryptedEntry {
+	return slices.DeleteFunc(entries, func(e leftEncryptedEntry) bool { return e.Path == path })
+}
+
+// editLeftEncrypted replaces the entries of the state file with the result of
+// edit. The state file is locked while it's edited, smudge runs in concurrent
+// processes, and never left half written. It's removed if no entries are
+// left. Outside of a repository, eg smudge run by hand, there's no state file
+// and nothing is done.
+func editLeftEncrypted(edit func(entries []leftEncryptedEntry) []leftEncryptedEntry) error {
+	dir, err := gitDir()
+	if err != nil {
+		return nil
+	}
+	stateFile := filepath.Join(dir, leftEncryptedFilename)
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0o755); err != nil {
+		return err
+	}
+	unlock, err := lockFile(stateFile + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := readLeftEncrypted(stateFile)
+	if err != nil {
+		return err
+	}
+	entries = edit(entries)
+	if len(entries) == 0 {
+		if err := os.Remove(stateFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	var content []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, line...), '\n')
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(stateFile), ".left-encrypted-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), stateFile)
+}
+
+// readLeftEncrypted returns the entries of the state file, malformed lines
+// are skipped
+func readLeftEncrypted(stateFile string) ([]leftEncryptedEntry, error) {
+	content, err := os.ReadFile(stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []leftEncryptedEntry
+	for _, line := range strings.Split(string(content), "\n") {
+		var e leftEncryptedEntry
+		if json.Unmarshal([]byte(line), &e) == nil && e.Path != "" {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSmudgeLeftEncrypted(t *testing.T) {
+	encrypted := ageEncryptTest(t, "t0ps3cret\n", testRecipients(t)...)
+	useTestIdentities(t)
+	testIdentityFilename := identityFilename
+	t.Cleanup(func() { identitiesOnce = sync.Once{} })
+	repoDir := setupTestRepo(t)
+
+	identityFilename = filepath.Join(repoDir, "missing-identity")
+	identitiesOnce = sync.Once{}
+
+	// lenient, ciphertext is copied and the file recorded
+	t.Setenv("STRONGBOX_STRICT", "false")
+	strictOnce = sync.Once{}
+	var out bytes.Buffer
+	require.NoError(t, smudge(bytes.NewReader(encrypted), &out, "secrets/app.yaml", ""))
+	require.Equal(t, encrypted, out.Bytes())
+
+	state, err := os.ReadFile(filepath.Join(repoDir, ".git", leftEncryptedFilename))
+	require.NoError(t, err)
+	var entry leftEncryptedEntry
+	require.NoError(t, json.Unmarshal(state, &entry))
+	require.Equal(t, "secrets/app.yaml", entry.Path)
+	require.Contains(t, entry.Reason, "missing-identity")
+
+	// a file keeps a single entry, temporary files of merges aren't recorded
+	require.NoError(t, smudge(bytes.NewReader(encrypted), &out, "secrets/app.yaml", ""))
+	mergeTemp := filepath.Join(t.TempDir(), ".merge_file_a")
+	require.NoError(t, os.WriteFile(mergeTemp, encrypted, 0o644))
+	tempFile, err := smudgeToFile(mergeTemp)
+	require.NoError(t, err)
+	os.Remove(tempFile)
+	state, err = os.ReadFile(filepath.Join(repoDir, ".git", leftEncryptedFilename))
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(state), "\n"))
+	require.NoFileExists(t, filepath.Join(repoDir, ".git", leftEncryptedFilename+".lock"))
+
+	// strict, from git config
+	os.Unsetenv("STRONGBOX_STRICT")
+	mustGit(t, "config", "strongbox.strict", "true")
+	strictOnce = sync.Once{}
+	out.Reset()
+	err = smudge(bytes.NewReader(encrypted), &out, "secrets/app.yaml", "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unable to decrypt secrets/app.yaml")
+	require.Contains(t, err.Error(), "missing-identity")
+	require.Empty(t, out.Bytes())
+
+	// strict mode doesn't affect files we can decrypt
+	identityFilename = testIdentityFilename
+	identitiesOnce = sync.Once{}
+	out.Reset()
+	require.NoError(t, smudge(bytes.NewReader(encrypted), &out, "secrets/app.yaml", ""))
+	require.Equal(t, "t0ps3cret\n", out.String())
+	// the entry is removed once the file is decrypted
+	require.NoFileExists(t, filepath.Join(repoDir, ".git", leftEncryptedFilename))
+
+	// outside of a repository there's no state file, nothing is logged
+	t.Chdir(t.TempDir())
+	gitDirOnce = sync.Once{}
+	t.Cleanup(func() { gitDirOnce = sync.Once{} })
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	out.Reset()
+	require.NoError(t, smudge(strings.NewReader("plaintext\n"), &out, "app.yaml", ""))
+	require.Equal(t, "plaintext\n", out.String())
+	require.Empty(t, logged.String())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+// fileStatus describes a tracked `filter=strongbox` file, CanDecrypt is only
+// meaningful if the index blob is encrypted
+type fileStatus struct {
+	Path string `json:"path"`
+	// Backend is either age or siv, depending on KeyFile, or none if the
+	// recipient file leaves it unencrypted. It's empty if no recipient or
+	// key-id file applies to the file.
+	Backend string `json:"backend"`
+	KeyFile string `json:"key_file"`
+	// Recipients are the names, or keys, of the age recipients
+	Recipients        []string `json:"recipients,omitempty"`
+	IndexEncrypted    bool     `json:"index_encrypted"`
+	WorktreeDecrypted bool     `json:"worktree_decrypted"`
+	CanDecrypt        bool     `json:"can_decrypt"`
+	Error             string   `json:"error,omitempty"`
+}
+
+// status writes the status of every tracked strongbox file to w, either as
+// a table or as a JSON array
+func status(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	jsonOutput := flags.Bool("json", false, "Print the status as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := chdirTopLevel(); err != nil {
+		return err
+	}
+	files, err := strongboxFiles()
+	if err != nil {
+		return err
+	}
+	statuses := make([]fileStatus, 0, len(files))
+	for _, file := range files {
+		statuses = append(statuses, statusOf(file))
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tBACKEND\tKEY FILE\tINDEX\tWORKTREE\tDECRYPT")
+	for _, s := range statuses {
+		index, worktree, decrypt := "plaintext", "encrypted", "-"
+		if s.IndexEncrypted {
+			index, decrypt = "encrypted", "no"
+			if s.CanDecrypt {
+				decrypt = "yes"
+			}
+		}
+		if s.WorktreeDecrypted {
+			worktree = "decrypted"
+		}
+		backend, keyFile := s.Backend, s.KeyFile
+		if backend == "" {
+			backend, keyFile = "-", "-"
+		}
+		switch {
+		case s.Error != "" && s.IndexEncrypted:
+			decrypt = "no: " + s.Error
+		case s.Error != "":
+			decrypt = "error: " + s.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Path, backend, keyFile, index, worktree, decrypt)
+	}
+	return tw.Flush()
+}
+
+func statusOf(file string) fileStatus {
+	s := fileStatus{Path: file}
+
+	keyFile, _, err := strongbox.FindKeyFile(gitRepository{}, file)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	switch filepath.Base(keyFile) {
+	case strongbox.RecipientFilename, strongbox.RecipientDirname:
+		s.Backend = "age"
+		_, recipients, err := strongbox.FindRecipients(file, options(""))
+		if err != nil {
+			s.Error = err.Error()
+		} else if len(recipients) == 0 {
+			s.Backend = "none"
+		}
+		for _, r := range recipients {
+			s.Recipients = append(s.Recipients, r.String())
+		}
+	case strongbox.KeyIDFilename:
+		s.Backend = "siv"
+	}
+	s.KeyFile = filepath.ToSlash(keyFile)
+
+	if content, err := os.ReadFile(file); err == nil {
+		s.WorktreeDecrypted = !strongbox.IsEncrypted(content)
+	}
+
+	blob, ok, err := catFile.Object(":" + file)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.IndexEncrypted = ok && strongbox.IsEncrypted(blob)
+	if !s.IndexEncrypted {
+		return s
+	}
+
+	// decrypt the same way as the smudge filter
+	opts := options("")
+	opts.LeftEncrypted = func(filename string, err error) error {
+		return explainDecryptError(err)
+	}
+	if err := strongbox.Smudge(bytes.NewReader(blob), io.Discard, file, opts); err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.CanDecrypt = true
+	return s
+}
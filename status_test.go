@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	useTestIdentities(t)
+	key, keyID := useTestKeyRing(t)
+	unknown, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipient, err := os.ReadFile(filepath.Join("testdata", ".strongbox_recipient"))
+	require.NoError(t, err)
+	ageRecipients := []string{strings.TrimSpace(string(recipient))}
+	ageEnc := ageEncryptTest(t, "age-secret\n", testRecipients(t)...)
+	unknownEnc := ageEncryptTest(t, "unknown-secret\n", unknown.Recipient())
+	sivEnc := sivEncryptTest(t, "siv-secret\n", key)
+
+	setupTestRepo(t)
+	addTestFiles(t, map[string][]byte{
+		".gitattributes":                   []byte("secrets/*/secret* filter=strongbox\n"),
+		"secrets/age/.strongbox_recipient": recipient,
+		"secrets/age/secret":               ageEnc,
+		"secrets/age/secret-unknown":       unknownEnc,
+		"secrets/age/secret-plain":         []byte("plain\n"),
+		"secrets/siv/.strongbox-keyid":     []byte(keyID + "\n"),
+		"secrets/siv/secret":               sivEnc,
+	})
+	require.NoError(t, os.WriteFile("secrets/age/secret", []byte("age-secret\n"), 0o644))
+
+	var out bytes.Buffer
+	require.NoError(t, status(&out, []string{"--json"}))
+	var statuses []fileStatus
+	require.NoError(t, json.Unmarshal(out.Bytes(), &statuses))
+	for i := range statuses {
+		statuses[i].Error = ""
+	}
+	require.Equal(t, []fileStatus{
+		{Path: "secrets/age/secret", Backend: "age", KeyFile: "secrets/age/.strongbox_recipient", Recipients: ageRecipients, IndexEncrypted: true, WorktreeDecrypted: true, CanDecrypt: true},
+		{Path: "secrets/age/secret-plain", Backend: "age", KeyFile: "secrets/age/.strongbox_recipient", Recipients: ageRecipients, WorktreeDecrypted: true},
+		{Path: "secrets/age/secret-unknown", Backend: "age", KeyFile: "secrets/age/.strongbox_recipient", Recipients: ageRecipients, IndexEncrypted: true},
+		{Path: "secrets/siv/secret", Backend: "siv", KeyFile: "secrets/siv/.strongbox-keyid", IndexEncrypted: true, CanDecrypt: true},
+	}, statuses)
+
+	out.Reset()
+	require.NoError(t, status(&out, nil))
+	require.Contains(t, out.String(), "secrets/age/secret-unknown")
+	require.Contains(t, out.String(), "no identity matched")
+}
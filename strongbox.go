@@ -2,19 +2,23 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"filippo.io/age"
 	"filippo.io/age/armor"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
 )
 
 // https://stackoverflow.com/a/28323276
@@ -43,27 +47,50 @@ var (
 	flagGenKey       = flag.String("gen-key", "", "Generate a new key and add it to your strongbox keyring")
 	flagGitConfig    = flag.Bool("git-config", false, "Configure git for strongbox use")
 	flagIdentityFile = flag.String("identity-file", "", "strongbox identity file, if not set default '$HOME/.strongbox_identity' will be used")
-	flagKey          = flag.String("key", "", "Private key to use to decrypt")
+	flagKey          = flag.String("key", "", "Private key to use to decrypt, either a siv key or an age identity")
+	flagKeyFile      = flag.String("key-file", "", "Read the private key to use to decrypt from a file, either a siv key or age identities")
+	flagKeyStdin     = flag.Bool("key-stdin", false, "Read the private key to use to decrypt from stdin, either a siv key or age identities")
 	flagKeyRing      = flag.String("keyring", "", "strongbox keyring file path, if not set default '$HOME/.strongbox_keyring' will be used")
+	flagPassphrase   = flag.Bool("passphrase", false, "Encrypt the identity file with a passphrase, must be used with -gen-identity")
 	flagRecursive    = flag.Bool("recursive", false, "Recursively decrypt all files under given folder, must be used with -decrypt flag")
 
 	flagClean  = flag.String("clean", "", "intended to be called internally by git")
 	flagSmudge = flag.String("smudge", "", "intended to be called internally by git")
 	flagDiff   = flag.String("diff", "", "intended to be called internally by git")
 
+	flagFilterProcess = flag.Bool("filter-process", false, "intended to be called internally by git")
+	flagHook          = flag.String("hook", "", "intended to be called internally by git hooks")
+
 	flagVersion = flag.Bool("version", false, "Strongbox version")
 )
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage:\n\n")
 	fmt.Fprintf(os.Stderr, "\tstrongbox -git-config\n")
-	fmt.Fprintf(os.Stderr, "\tstrongbox [-identity-file PATH] -gen-identity IDENTITY_NAME\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-identity-file PATH] -gen-identity IDENTITY_NAME [-passphrase]\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-identity-file PATH] identity list\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-identity-file PATH] identity describe DESCRIPTION|PUBLIC_KEY NEW_DESCRIPTION\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-identity-file PATH] identity remove DESCRIPTION|PUBLIC_KEY\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-identity-file PATH] identity check [-fix]\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-identity-file PATH] identity encrypt\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-identity-file PATH] identity export [DESCRIPTION|PUBLIC_KEY]\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-identity-file PATH] identity import [FILE]\n")
 	fmt.Fprintf(os.Stderr, "\tstrongbox [-keyring KEYRING_FILEPATH] -gen-key KEY_NAME\n")
-	fmt.Fprintf(os.Stderr, "\tstrongbox [-keyring KEYRING_FILEPATH] -decrypt -recursive [-key KEY] [PATH]\n")
-	fmt.Fprintf(os.Stderr, "\tstrongbox [-keyring KEYRING_FILEPATH] -decrypt -key KEY [PATH]\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-keyring KEYRING_FILEPATH] [-identity-file PATH] -decrypt -recursive [-key KEY | -key-file PATH | -key-stdin] [PATH]\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-keyring KEYRING_FILEPATH] [-identity-file PATH] -decrypt [-key KEY | -key-file PATH | -key-stdin] [PATH]\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-keyring KEYRING_FILEPATH] [-identity-file PATH] refresh\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-keyring KEYRING_FILEPATH] [-identity-file PATH] status [-json]\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-keyring KEYRING_FILEPATH] [-identity-file PATH] agent [-socket PATH] [-timeout DURATION]\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox recipients add [-dir PATH] [-name NAME] KEY\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox recipients remove [-dir PATH] KEY\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox [-identity-file PATH] unlock-threshold [-identity PATH]... [-agent SOCKET]... [-o PATH] FILE\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox install-hooks\n")
+	fmt.Fprintf(os.Stderr, "\tstrongbox verify-push [OLD NEW REF]\n")
 	fmt.Fprintf(os.Stderr, "\tstrongbox -version\n")
 	fmt.Fprintf(os.Stderr, "\n(age) if -identity-file flag is not set, default '$HOME/.strongbox_identity' will be used\n")
 	fmt.Fprintf(os.Stderr, "(siv) if -keyring flag is not set default file '$HOME/.strongbox_keyring' or '$STRONGBOX_HOME/.strongbox_keyring' will be used as keyring\n")
+	fmt.Fprintf(os.Stderr, "(age) $%s or $%s, the content of an identity file or the file descriptor to read it from, replace the identity file\n", identityEnv, identityFDEnv)
+	fmt.Fprintf(os.Stderr, "(siv) $%s, the content of a keyring file, replaces the keyring file\n", keyRingEnv)
 	os.Exit(2)
 }
 
@@ -86,28 +113,51 @@ func main() {
 		return
 	}
 
-	if *flagDiff != "" {
-		diff(*flagDiff)
-		return
-	}
-
 	// Set up keyring file name
 	home := deriveHome()
-	kr = &fileKeyRing{fileName: filepath.Join(home, ".strongbox_keyring")}
+	kr = &cachedKeyRing{keyRing: strongbox.NewFileKeyRing(filepath.Join(home, ".strongbox_keyring"))}
 
 	if *flagIdentityFile != "" {
 		identityFilename = *flagIdentityFile
 	} else {
 		identityFilename = filepath.Join(home, defaultIdentityFilename)
 	}
+	if userHome, err := os.UserHomeDir(); err == nil {
+		sshIdentityFilenames = []string{
+			filepath.Join(userHome, ".ssh", "id_ed25519"),
+			filepath.Join(userHome, ".ssh", "id_rsa"),
+		}
+	}
 
 	// if keyring flag is set replace default keyRing
 	if *flagKeyRing != "" {
-		kr = &fileKeyRing{fileName: *flagKeyRing}
+		kr = &cachedKeyRing{keyRing: strongbox.NewFileKeyRing(*flagKeyRing)}
 		// verify keyring is valid
 		if err := kr.Load(); err != nil {
 			log.Fatalf("unable to load keyring file:%s err:%s", *flagKeyRing, err)
 		}
+	} else if content, ok := os.LookupEnv(keyRingEnv); ok {
+		kr = &cachedKeyRing{keyRing: newEnvKeyRing(content)}
+	}
+
+	// identities given by flags take precedence over the environment
+	_, identityEnvSet := os.LookupEnv(identityEnv)
+	_, identityFDEnvSet := os.LookupEnv(identityFDEnv)
+	_, keyRingEnvSet := os.LookupEnv(keyRingEnv)
+	useIdentityEnv = *flagIdentityFile == ""
+	keysGiven := *flagIdentityFile != "" || *flagKeyRing != "" || *flagKey != "" || *flagKeyFile != "" || *flagKeyStdin ||
+		identityEnvSet || identityFDEnvSet || keyRingEnvSet
+
+	// the agent holds the identities and keys, unless others are given
+	if !keysGiven && flag.Arg(0) != "agent" {
+		if agentSocket = os.Getenv(agentSocketEnv); agentSocket != "" {
+			kr = &agentKeyRing{keyRing: kr, socket: agentSocket}
+		}
+	}
+
+	if *flagDiff != "" {
+		diff(*flagDiff)
+		return
 	}
 
 	if *flagGenKey != "" {
@@ -116,10 +166,22 @@ func main() {
 	}
 
 	if *flagDecrypt {
+		// 'key' flag is optional but if provided it should be valid and all
+		// encrypted files of the same type will be decrypted using it
+		if *flagKeyStdin && flag.Arg(0) == "" && !*flagRecursive {
+			log.Fatal("-key-stdin requires the PATH to decrypt")
+		}
+		k, err := keyFromFlags(*flagKey, *flagKeyFile, *flagKeyStdin, os.Stdin)
+		if err != nil {
+			log.Fatalf("Unable to read given private key %v", err)
+		}
+		dk, identities, err := parseKeyFlag(k)
+		if err != nil {
+			log.Fatalf("Unable to decode given private key %v", err)
+		}
+
 		// handle recursive
 		if *flagRecursive {
-			var err error
-
 			target := flag.Arg(0)
 			if target == "" {
 				target, err = os.Getwd()
@@ -127,23 +189,14 @@ func main() {
 					log.Fatalf("target path not provided and unable to get cwd err:%s", err)
 				}
 			}
-			// for recursive decryption 'key' flag is optional but if provided
-			// it should be valid and all encrypted file will be decrypted using it
-			dk, err := decode([]byte(*flagKey))
-			if err != nil && *flagKey != "" {
-				log.Fatalf("Unable to decode given private key %v", err)
-			}
 
-			if err = recursiveDecrypt(target, dk); err != nil {
+			if err = recursiveDecrypt(target, dk, identities); err != nil {
 				log.Fatalln(err)
 			}
 			return
 		}
 
-		if *flagKey == "" {
-			log.Fatalf("Must provide a `-key` when using -decrypt")
-		}
-		decryptCLI()
+		decryptCLI(dk, identities)
 		return
 	}
 
@@ -152,17 +205,46 @@ func main() {
 		usage()
 	}
 
+	if *flagPassphrase && *flagGenIdentity == "" {
+		log.Println("-passphrase flag is only supported with -gen-identity")
+		usage()
+	}
+
 	if *flagGenIdentity != "" {
-		ageGenIdentity(*flagGenIdentity)
+		ageGenIdentity(*flagGenIdentity, *flagPassphrase)
+		return
+	}
+
+	if *flagFilterProcess {
+		err := filterProcess(os.Stdin, os.Stdout)
+		catFile.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *flagHook != "" {
+		err := runHook(*flagHook, os.Stdin, os.Stderr)
+		catFile.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 
 	if *flagClean != "" {
-		clean(os.Stdin, os.Stdout, *flagClean)
+		err := clean(os.Stdin, os.Stdout, *flagClean)
+		catFile.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 	if *flagSmudge != "" {
-		smudge(os.Stdin, os.Stdout, *flagSmudge)
+		if err := smudge(os.Stdin, os.Stdout, *flagSmudge, ""); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 	if len(mergeFileFlags) > 0 {
@@ -171,6 +253,49 @@ func main() {
 		}
 		os.Exit(mergeFile())
 	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "refresh":
+		if err := refresh(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	case "status":
+		if err := status(os.Stdout, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	case "identity":
+		if err := identityCommand(os.Stdout, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	case "agent":
+		if err := runAgent(os.Stdout, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	case "recipients":
+		err := recipientsCommand(os.Stdout, flag.Args()[1:])
+		catFile.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "unlock-threshold":
+		if err := unlockThreshold(os.Stdout, os.Stdin, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	case "install-hooks":
+		if err := installHooks(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	case "verify-push":
+		err := verifyReceive(flag.Args()[1:], os.Stdin, os.Stderr)
+		catFile.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Printf("unknown command %q", flag.Arg(0))
+		usage()
+	}
 }
 
 func deriveHome() string {
@@ -192,33 +317,153 @@ func deriveHome() string {
 	return ""
 }
 
-func decryptCLI() {
-	var fn string
+// parseKeyFlag returns either a siv key or age identities, depending on
+// the kind of key passed to `-key`, `-key-file` or `-key-stdin`. Identities
+// can be given as the content of an identity file.
+func parseKeyFlag(k string) ([]byte, []age.Identity, error) {
+	k = strings.TrimSpace(k)
+	if k == "" {
+		return nil, nil, nil
+	}
+	if strings.Contains(k, "AGE-") || strongbox.IsSSHPrivateKey([]byte(k)) || strongbox.IsPassphraseProtected([]byte(k)) {
+		identities, err := parseIdentityFile("given key", []byte(k))
+		return nil, identities, err
+	}
+	key, err := base64.StdEncoding.DecodeString(k)
+	return key, nil, err
+}
+
+func decryptCLI(givenKey []byte, givenIdentities []age.Identity) {
+	var fn, path string
 	if flag.Arg(0) == "" {
 		// no file passed, try to read stdin
 		fn = "/dev/stdin"
 	} else {
 		fn = flag.Arg(0)
+		path = fn
 	}
 	fb, err := os.ReadFile(fn)
 	if err != nil {
 		log.Fatalf("Unable to read file to decrypt %v", err)
 	}
-	dk, err := decode([]byte(*flagKey))
-	if err != nil {
-		log.Fatalf("Unable to decode private key %v", err)
-	}
-	out, err := decrypt(fb, dk)
+	out, err := decryptResource(fb, path, givenKey, givenIdentities)
 	if err != nil {
 		log.Fatalf("Unable to decrypt %v", err)
 	}
 	fmt.Printf("%s", out)
 }
 
+// recursiveDecrypt will try and recursively decrypt age and siv files
+// if 'key' or 'identities' are provided then it will decrypt all encrypted
+// files of that type with them, otherwise it will use the identity file and
+// find siv key based on file location
+// if error is generated in finding key or in decryption then it will continue with next file
+// function will only return early if it failed to read/write files
+func recursiveDecrypt(target string, givenKey []byte, givenIdentities []age.Identity) error {
+	var decErrors []string
+	err := filepath.WalkDir(target, func(path string, entry fs.DirEntry, err error) error {
+		// always return on error
+		if err != nil {
+			return err
+		}
+
+		// only process files
+		if entry.IsDir() {
+			// skip .git directory
+			if entry.Name() == ".git" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		// for optimisation only read required chunk of the file and verify if encrypted
+		chunk := make([]byte, max(len(strongbox.Prefix), len(armor.Header)))
+		_, err = file.Read(chunk)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if !strongbox.IsEncrypted(chunk) {
+			return nil
+		}
+
+		// read entire file from the beginning
+		file.Seek(0, io.SeekStart)
+		in, err := io.ReadAll(file)
+		if err != nil {
+			return err
+		}
+
+		out, err := decryptResource(in, path, givenKey, givenIdentities)
+		if err != nil {
+			// continue with next file
+			decErrors = append(decErrors, fmt.Sprintf("unable to decrypt file:%s err:%s", path, err))
+			return nil
+		}
+
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := file.Write(out); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(decErrors) > 0 {
+		for _, e := range decErrors {
+			log.Println(e)
+		}
+		return fmt.Errorf("unable to decrypt some files")
+	}
+
+	return nil
+}
+
+// decryptResource decrypts age or siv content, given key and identities take
+// precedence over the keyring and identity file. path is used to find the siv
+// key-id, if it's empty or the key-id can't be found all keys in the keyring
+// are tried
+func decryptResource(in []byte, path string, givenKey []byte, givenIdentities []age.Identity) ([]byte, error) {
+	identities := givenIdentities
+	if len(identities) == 0 {
+		identities, _ = loadIdentities()
+	}
+	var keys strongbox.KeyRing = kr
+	if len(givenKey) > 0 {
+		keys = strongbox.StaticKeyRing{givenKey}
+	} else if path != "" {
+		if key, err := keyLoader(path, ""); err == nil {
+			keys = strongbox.StaticKeyRing{key}
+		}
+	}
+
+	var out bytes.Buffer
+	err := strongbox.Decrypt(bytes.NewReader(in), &out, identities, keys)
+	if errors.Is(err, strongbox.ErrNoIdentities) {
+		if _, loadErr := loadIdentities(); loadErr != nil {
+			return nil, fmt.Errorf("unable to load identities: %w", loadErr)
+		}
+	}
+	return out.Bytes(), err
+}
+
 func gitConfig() {
 	args := [][]string{
 		{"config", "--global", "--replace-all", "filter.strongbox.clean", "strongbox -clean %f"},
 		{"config", "--global", "--replace-all", "filter.strongbox.smudge", "strongbox -smudge %f"},
+		{"config", "--global", "--replace-all", "filter.strongbox.process", "strongbox -filter-process"},
 		{"config", "--global", "--replace-all", "filter.strongbox.required", "true"},
 
 		{"config", "--global", "--replace-all", "diff.strongbox.textconv", "strongbox -diff"},
@@ -233,104 +478,88 @@ func gitConfig() {
 	log.Println("git global configuration updated successfully")
 }
 
+// Called by git as textconv, filename is either the working copy or a
+// temporary file holding a blob from history
 func diff(filename string) {
-	f, err := os.Open(filename)
+	in, err := os.ReadFile(filename)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer func() {
-		if err = f.Close(); err != nil {
-			log.Fatal(err)
-		}
-	}()
-	_, err = io.Copy(os.Stdout, f)
-	if err != nil {
+	if err := textconv(os.Stdout, in); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func clean(r io.Reader, w io.Writer, filename string) {
-	// Read the file, fail on error
-	in, err := io.ReadAll(r)
-	if err != nil {
-		log.Fatal(err)
-	}
-	// Check the file is plaintext, if its an encrypted strongbox or age file, copy as is, and exit 0
-	if bytes.HasPrefix(in, prefix) || strings.HasPrefix(string(in), armor.Header) {
-		_, err = io.Copy(w, bytes.NewReader(in))
-		if err != nil {
-			log.Fatal(err)
-		}
-		return
-	}
-	// File is plaintext and needs to be encrypted, get the recipient or a
-	// key, fail on error
-	recipient, key, err := findRecipients(filename)
-	if err != nil {
-		log.Fatal(err)
-	}
+// textconv decrypts age or siv content if we hold the key, otherwise content
+// is copied as is
+func textconv(w io.Writer, in []byte) error {
+	identities, _ := loadIdentities()
+	// the original path isn't known so siv key-id can't be looked up, all
+	// keys in the keyring are tried instead
+	var out bytes.Buffer
+	if err := strongbox.Decrypt(bytes.NewReader(in), &out, identities, kr); err == nil {
+		in = out.Bytes()
+	}
+	_, err := io.Copy(w, bytes.NewReader(in))
+	return err
+}
 
-	// found recipient file and plaintext differs from HEAD
-	if recipient != nil {
-		ageEncrypt(w, recipient, in, filename)
-	}
-	if key != nil {
-		// encrypt the file, fail on error
-		out, err := encrypt(in, key)
-		if err != nil {
-			log.Fatal(err)
-		}
-		// write out encrypted file, fail on error
-		_, err = io.Copy(w, bytes.NewReader(out))
-		if err != nil {
-			log.Fatal(err)
-		}
+// options returns the identities, keyring and repository used by the git
+// filters, treeish is the tree being checked out if known
+func options(treeish string) strongbox.Options {
+	identities, _ := loadIdentities()
+	return strongbox.Options{
+		Identities:         identities,
+		KeyRing:            kr,
+		Repository:         gitRepository{treeish: treeish},
+		LeftEncrypted:      leftEncrypted,
+		AllowedSignersFile: allowedSignersFile,
+		Passphrase:         repoPassphrase,
+		PluginUI:           pluginUI,
+		Reencrypt:          os.Getenv(reencryptEnv) != "",
 	}
 }
 
-// Called by git on `git checkout`
-func smudge(r io.Reader, w io.Writer, filename string) {
-	in, err := io.ReadAll(r)
-	if err != nil {
-		log.Fatal(err)
-	}
+// invalidPolicyOnce reports a policy which can't be parsed once, rather than
+// for every file cleaned by the filter process
+var invalidPolicyOnce sync.Once
 
-	if strings.HasPrefix(string(in), armor.Header) {
-		ageDecrypt(w, in)
-		return
-	}
-	if bytes.HasPrefix(in, prefix) {
-		key, err := keyLoader(filename)
-		if err != nil {
-			// don't log error if its keyNotFound
-			switch err {
-			case errKeyNotFound:
-			default:
-				log.Println(err)
-			}
-			// Couldn't load the key, just copy as is and return
-			if _, err = io.Copy(w, bytes.NewReader(in)); err != nil {
-				log.Println(err)
-			}
-			return
-		}
+// cleanOptions returns the options used by the clean filter, files are
+// encrypted for the key files of the working tree
+func cleanOptions() strongbox.Options {
+	opts := options("")
+	opts.Repository = gitRepository{worktree: true}
+	return opts
+}
 
-		out, err := decrypt(in, key)
-		if err != nil {
-			log.Println(err)
-			out = in
-		}
-		if _, err := io.Copy(w, bytes.NewReader(out)); err != nil {
-			log.Println(err)
-		}
-		return
+func clean(r io.Reader, w io.Writer, filename string) error {
+	err := strongbox.Clean(r, w, filename, cleanOptions())
+	if errors.Is(err, strongbox.ErrInvalidPolicy) {
+		invalidPolicyOnce.Do(func() { log.Print(err) })
+		return strongbox.ErrInvalidPolicy
 	}
+	return err
+}
 
-	// file is a non-siv and non-age file, copy as is and exit
-	_, err = io.Copy(w, bytes.NewReader(in))
-	if err != nil {
-		log.Fatal(err)
+// Called by git on `git checkout`, treeish is the tree being checked out if
+// known. Files left encrypted are recorded in the state file, and removed from
+// it once decrypted.
+func smudge(r io.Reader, w io.Writer, filename, treeish string) error {
+	opts := options(treeish)
+	left := false
+	opts.LeftEncrypted = func(filename string, err error) error {
+		left = true
+		return leftEncrypted(filename, err)
+	}
+	if err := strongbox.Smudge(r, w, filename, opts); err != nil {
+		return err
+	}
+	if !left {
+		if err := clearLeftEncrypted(filename); err != nil {
+			log.Printf("unable to update %s: %s", leftEncryptedFilename, err)
+		}
 	}
+	return nil
 }
 
 func mergeFile() int {
@@ -421,9 +650,16 @@ func smudgeToFile(filename string) (string, error) {
 	}
 	defer file.Close()
 
-	// Create a buffer to hold the processed output
+	// Create a buffer to hold the processed output. filename is a temporary
+	// file of git, it's not recorded in the state file if left encrypted.
+	opts := options("")
+	opts.LeftEncrypted = func(filename string, err error) error {
+		return leaveEncrypted(filename, explainDecryptError(err))
+	}
 	var buf strings.Builder
-	smudge(file, &buf, filename)
+	if err := strongbox.Smudge(file, &buf, filename, opts); err != nil {
+		return "", fmt.Errorf("failed to smudge file %s: %w", filename, err)
+	}
 
 	// Write the buffer content to a temporary file
 	return createTempFile(buf.String()), nil
@@ -444,28 +680,3 @@ func createTempFile(content string) string {
 
 	return tmpFile.Name() // Return the file path
 }
-
-// Finds closest age recipient or siv keyid
-func findRecipients(filename string) ([]age.Recipient, []byte, error) {
-	path := filepath.Dir(filename)
-	for {
-		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
-			ageRecipientFilename := filepath.Join(path, recipientFilename)
-			// If we found `.strongbox_recipient` - parse it and return
-			if keyFile, err := os.Stat(ageRecipientFilename); err == nil && !keyFile.IsDir() {
-				recipients, err := ageFileToRecipient(ageRecipientFilename)
-				return recipients, nil, err
-			}
-			// If we found `strongbox-keyid` - get the corresponding key and return it
-			keyFilename := filepath.Join(path, ".strongbox-keyid")
-			if keyFile, err := os.Stat(keyFilename); err == nil && !keyFile.IsDir() {
-				key, err := sivFileToKey(keyFilename)
-				return nil, key, err
-			}
-		}
-		if path == "." {
-			return nil, nil, fmt.Errorf("failed to find recipient or keyid for file %s", filename)
-		}
-		path = filepath.Dir(path)
-	}
-}
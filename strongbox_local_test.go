@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
+	"filippo.io/age"
 	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
 )
 
 const _STRONGBOX_TEST_BINARY = "strongbox-test-bin"
@@ -124,6 +131,68 @@ func configureStrongbox(t *testing.T, repoDir string) {
 	t.Setenv("STRONGBOX_HOME", filepath.Join(repoDir, "testdata"))
 }
 
+// useTestIdentities makes strongbox use the identity file from testdata
+func useTestIdentities(t *testing.T) {
+	t.Helper()
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	identityFilename = filepath.Join(cwd, "testdata", defaultIdentityFilename)
+	identitiesOnce = sync.Once{}
+}
+
+// useTestKeyRing makes strongbox use a new keyring holding a single random
+// key, it returns the key and its key-id
+func useTestKeyRing(t *testing.T) (key []byte, keyID string) {
+	t.Helper()
+	key = make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	id := sha256.Sum256(key)
+
+	kr = &cachedKeyRing{keyRing: strongbox.NewFileKeyRing(filepath.Join(t.TempDir(), ".strongbox_keyring"))}
+	kr.AddKey("test", id[:], key)
+	require.NoError(t, kr.Save())
+	return key, base64.StdEncoding.EncodeToString(id[:])
+}
+
+func testRecipients(t *testing.T) []age.Recipient {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", strongbox.RecipientFilename))
+	require.NoError(t, err)
+	defer f.Close()
+	recipients, err := strongbox.ParseRecipients(f)
+	require.NoError(t, err)
+	return recipients
+}
+
+func ageEncryptTest(t *testing.T, plaintext string, recipients ...age.Recipient) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	require.NoError(t, strongbox.Encrypt(strings.NewReader(plaintext), &enc, recipients))
+	return enc.Bytes()
+}
+
+func sivEncryptTest(t *testing.T, plaintext string, key []byte) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	require.NoError(t, strongbox.EncryptSIV(strings.NewReader(plaintext), &enc, key))
+	return enc.Bytes()
+}
+
+// addTestFiles writes files to the current repository and adds them to the
+// index. The strongbox filter isn't configured in the repositories of
+// setupTestRepo, so the files are added as is, which lets tests stage
+// encrypted blobs and their decrypted worktree files independently.
+func addTestFiles(t *testing.T, files map[string][]byte) {
+	t.Helper()
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0o755))
+		require.NoError(t, os.WriteFile(name, content, 0o600))
+	}
+	mustGit(t, "add", ".")
+}
+
 func setupWorkTree(t *testing.T, name string) string {
 	t.Helper()
 	worktreePath := filepath.Join(t.TempDir(), name)
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+// unlockThreshold is `strongbox unlock-threshold`, it decrypts a file
+// encrypted for a recipient file with `@threshold k` by combining the shares
+// of the identity, the identity files and the agents given
+func unlockThreshold(w io.Writer, stdin io.Reader, args []string) error {
+	flags := flag.NewFlagSet("unlock-threshold", flag.ContinueOnError)
+	var identityFiles, agentSockets arrayFlags
+	flags.Var(&identityFiles, "identity", "Identity file of a custodian, can be repeated")
+	flags.Var(&agentSockets, "agent", "Socket of the strongbox agent of a custodian, can be repeated")
+	output := flags.String("o", "", "Write the plaintext to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: strongbox unlock-threshold [-identity PATH]... [-agent SOCKET]... [-o PATH] FILE")
+	}
+	name := flags.Arg(0)
+
+	var in []byte
+	var err error
+	if name == "-" {
+		in, err = io.ReadAll(stdin)
+	} else {
+		in, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the user's own identity may hold a share too
+	identities, _ := loadIdentities()
+	for _, filename := range identityFiles {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		parsed, err := parseIdentityFile(filename, content)
+		if err != nil {
+			return fmt.Errorf("unable to parse %s: %w", filename, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	for _, socket := range agentSockets {
+		identities = append(identities, agentIdentity{socket: socket})
+	}
+	if len(identities) == 0 {
+		return errors.New("no identities given, use -identity or -agent")
+	}
+
+	var out bytes.Buffer
+	identity := strongbox.NewThresholdIdentity(identities)
+	if err := strongbox.Decrypt(bytes.NewReader(in), &out, []age.Identity{identity}, nil); err != nil {
+		return fmt.Errorf("unable to decrypt %s: %w", name, err)
+	}
+	if *output != "" {
+		return os.WriteFile(*output, out.Bytes(), 0o600)
+	}
+	_, err = w.Write(out.Bytes())
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox/strongboxtest"
+)
+
+func TestUnlockThreshold(t *testing.T) {
+	dir := t.TempDir()
+	var identityFiles, recipients []string
+	for _, name := range []string{"alice", "bob", "carol"} {
+		identity, err := age.GenerateX25519Identity()
+		require.NoError(t, err)
+		filename := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(filename, []byte(identity.String()+"\n"), 0o600))
+		identityFiles = append(identityFiles, filename)
+		recipients = append(recipients, identity.Recipient().String())
+	}
+	repo := strongboxtest.MemRepository{WorkTree: map[string]string{
+		strongbox.RecipientFilename: strongbox.ThresholdDirective + " 2\n" + strings.Join(recipients, "\n") + "\n",
+	}}
+	var encrypted bytes.Buffer
+	require.NoError(t, strongbox.Clean(strings.NewReader("root password\n"), &encrypted, "password", strongbox.Options{Repository: repo}))
+	file := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(file, encrypted.Bytes(), 0o644))
+
+	prevIdentityFilename, prevSSHIdentityFilenames := identityFilename, sshIdentityFilenames
+	t.Cleanup(func() {
+		identityFilename, sshIdentityFilenames = prevIdentityFilename, prevSSHIdentityFilenames
+		identitiesOnce = sync.Once{}
+	})
+	identitiesOnce = sync.Once{}
+	identityFilename, sshIdentityFilenames = identityFiles[0], nil
+
+	// the user's own identity and another custodian's
+	var out bytes.Buffer
+	require.NoError(t, unlockThreshold(&out, nil, []string{"-identity", identityFiles[2], file}))
+	require.Equal(t, "root password\n", out.String())
+
+	plaintextFile := filepath.Join(dir, "plaintext")
+	require.NoError(t, unlockThreshold(&out, bytes.NewReader(encrypted.Bytes()), []string{"-identity", identityFiles[1], "-identity", identityFiles[2], "-o", plaintextFile, "-"}))
+	plaintext, err := os.ReadFile(plaintextFile)
+	require.NoError(t, err)
+	require.Equal(t, "root password\n", string(plaintext))
+
+	err = unlockThreshold(&out, nil, []string{file})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "only 1 of the 2 required")
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/uw-labs/strongbox/v2/pkg/strongbox"
+)
+
+// changedBlob is a file added or modified by a commit (or in the index)
+type changedBlob struct {
+	path string
+	oid  string
+}
+
+// changedBlobs runs a git diff command with raw `-z` output, eg `git
+// diff-tree -r -z ...`, and returns the blobs it adds or modifies. Deleted
+// files, symlinks and submodules are skipped.
+func changedBlobs(args ...string) ([]changedBlob, error) {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+
+	// each entry is `:<old mode> <new mode> <old oid> <new oid> <status> NUL
+	// <path> NUL`, renames aren't detected so there is only one path
+	var blobs []changedBlob
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		meta := strings.Fields(strings.TrimPrefix(fields[i], ":"))
+		if len(meta) != 5 {
+			return nil, fmt.Errorf("unexpected git %s output %q", args[0], fields[i])
+		}
+		newMode, newOID, status := meta[1], meta[3], meta[4]
+		if status == "D" || !strings.HasPrefix(newMode, "100") {
+			continue
+		}
+		blobs = append(blobs, changedBlob{path: fields[i+1], oid: newOID})
+	}
+	return blobs, nil
+}
+
+// blobCheck returns why content of path in commit, empty for the index, is
+// rejected, or nil
+type blobCheck func(commit, path string, content []byte) error
+
+// isEncrypted only checks blobs start like an encrypted resource, the hooks
+// use it to catch files the filter didn't encrypt
+func isEncrypted(commit, path string, content []byte) error {
+	if !strongbox.IsEncrypted(content) && !leftUnencrypted(commit, path) {
+		return errors.New("not encrypted")
+	}
+	return nil
+}
+
+// leftUnencrypted returns true if the recipient file of path in commit, or the
+// working tree if empty, has strongbox.NoneDirective
+func leftUnencrypted(commit, path string) bool {
+	var repo strongbox.Repository = gitRepository{}
+	if commit != "" {
+		repo = commitRepository{commit: commit}
+	}
+	keyFile, _, err := strongbox.FindKeyFile(repo, path)
+	if err != nil || keyFile == "" || filepath.Base(keyFile) == strongbox.KeyIDFilename {
+		return false
+	}
+	// recipients are only parsed, nothing is asked for
+	_, recipients, err := strongbox.FindRecipients(path, strongbox.Options{
+		Repository:         repo,
+		AllowedSignersFile: allowedSignersFile,
+		Passphrase:         repoPassphrase,
+	})
+	return err == nil && len(recipients) == 0
+}
+
+// checkBlobs runs check on blobs which have the `filter=strongbox` attribute
+// and returns a `<path>: <reason>` line per rejected blob. Attributes are
+// read from the index, env is added to the environment of git check-attr,
+// eg to use a temporary index.
+func checkBlobs(commit string, blobs []changedBlob, check blobCheck, env ...string) ([]string, error) {
+	if len(blobs) == 0 {
+		return nil, nil
+	}
+	var paths bytes.Buffer
+	oids := make(map[string]string, len(blobs))
+	for _, b := range blobs {
+		paths.WriteString(b.path + "\x00")
+		oids[b.path] = b.oid
+	}
+	filtered, err := checkAttrFilter(paths.Bytes(), env, "--cached")
+	if err != nil {
+		return nil, err
+	}
+
+	var rejected []string
+	for _, path := range filtered {
+		content, ok, err := catFile.Object(oids[path])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("unable to read %s (%s)", path, oids[path])
+		}
+		if err := check(commit, path, content); err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s: %s", path, err))
+		}
+	}
+	return rejected, nil
+}
+
+// emptyTree returns the id of the empty tree, to diff against in repositories
+// without commits
+func emptyTree() (string, error) {
+	cmd := exec.Command("git", "hash-object", "-t", "tree", "--stdin")
+	cmd.Stdin = strings.NewReader("")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git hash-object failed: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// verifyCommits runs check on the blobs added or modified by every commit
+// listed by `git rev-list revs...` which `.gitattributes` of that commit
+// gives the `filter=strongbox` attribute. It returns a `<commit> <path>:
+// <reason>` line per rejected blob.
+func verifyCommits(check blobCheck, revs ...string) ([]string, error) {
+	out, err := exec.Command("git", append([]string{"rev-list", "--parents"}, revs...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git rev-list failed: %w", err)
+	}
+
+	// attributes are read from a temporary index holding each commit, this
+	// also works in bare repositories
+	tmp, err := os.MkdirTemp("", "strongbox-verify-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	env := "GIT_INDEX_FILE=" + filepath.Join(tmp, "index")
+
+	var rejected []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line == "" {
+			continue
+		}
+		commits := strings.Fields(line)
+		commit := commits[0]
+		// merges are checked against their first parent
+		args := []string{"diff-tree", "-r", "-z", "--no-renames", "--no-commit-id", "--root", commit}
+		if len(commits) > 1 {
+			args = []string{"diff-tree", "-r", "-z", "--no-renames", commits[1], commit}
+		}
+		blobs, err := changedBlobs(args...)
+		if err != nil {
+			return nil, err
+		}
+		if len(blobs) == 0 {
+			continue
+		}
+
+		readTree := exec.Command("git", "read-tree", commit)
+		readTree.Env = append(os.Environ(), env)
+		if out, err := readTree.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("git read-tree %s failed: %s", commit, out)
+		}
+		lines, err := checkBlobs(commit, blobs, check, env)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			rejected = append(rejected, commit+" "+line)
+		}
+	}
+	return rejected, nil
+}
+
+// verifyReceive is `strongbox verify-push`, it's used on the server either as
+// an update hook with `<old> <new> <ref>` arguments or as a pre-receive hook
+// reading `<old> <new> <ref>` lines from stdin. It rejects pushes of blobs
+// which have the `filter=strongbox` attribute but aren't well formed
+// encrypted resources or aren't governed by a recipient or key-id file.
+func verifyReceive(args []string, stdin io.Reader, w io.Writer) error {
+	var updates [][]string
+	switch len(args) {
+	case 3:
+		updates = [][]string{args}
+	case 0:
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) == 3 {
+				updates = append(updates, fields)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	default:
+		return errors.New("usage: strongbox verify-push [<old> <new> <ref>]")
+	}
+
+	var rejected []string
+	for _, update := range updates {
+		old, new, ref := update[0], update[1], update[2]
+		if isZeroOID(new) {
+			// deleting the ref
+			continue
+		}
+		revs := []string{new, "--not", "--all"}
+		if !isZeroOID(old) {
+			revs = []string{new, "--not", old}
+		}
+		lines, err := verifyCommits(checkPushedBlob, revs...)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			rejected = append(rejected, ref+" "+line)
+		}
+	}
+	if len(rejected) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(w, "strongbox: files with the filter=strongbox attribute aren't properly encrypted:\n")
+	for _, r := range rejected {
+		fmt.Fprintf(w, "\t%s\n", r)
+	}
+	return fmt.Errorf("push rejected, %d file(s) not properly encrypted", len(rejected))
+}
+
+func checkPushedBlob(commit, path string, content []byte) error {
+	if !strongbox.IsEncrypted(content) && leftUnencrypted(commit, path) {
+		return nil
+	}
+	if err := strongbox.CheckFraming(content); err != nil {
+		return err
+	}
+	keyFile, _, err := strongbox.FindKeyFile(commitRepository{commit: commit}, path)
+	if err != nil {
+		return err
+	}
+	if keyFile == "" {
+		return fmt.Errorf("no %s or %s in the commit", strongbox.RecipientFilename, strongbox.KeyIDFilename)
+	}
+	return nil
+}
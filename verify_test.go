@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyReceive(t *testing.T) {
+	recipient, err := os.ReadFile(filepath.Join("testdata", ".strongbox_recipient"))
+	require.NoError(t, err)
+	encrypted := ageEncryptTest(t, "secret\n", testRecipients(t)...)
+
+	repoDir := setupTestRepo(t)
+	commit := func(files map[string][]byte) string {
+		t.Helper()
+		addTestFiles(t, files)
+		mustGit(t, "commit", "--quiet", "--message", "commit")
+		return revParse(t, "HEAD")
+	}
+	first := commit(map[string][]byte{
+		".gitattributes":           []byte("*/secret* filter=strongbox\n"),
+		"app/.strongbox_recipient": recipient,
+		"app/secret":               encrypted,
+	})
+	good := commit(map[string][]byte{"app/secret-2": encrypted, "app/public": []byte("public\n")})
+	commit(map[string][]byte{"app/secret-3": []byte("plaintext\n")})
+	commit(map[string][]byte{"other/secret": encrypted})
+	last := commit(map[string][]byte{"app/secret-4": []byte(strings.Replace(string(encrypted), "\n", "\n!", 3))})
+
+	bareDir := t.TempDir()
+	mustGit(t, "clone", "--quiet", "--bare", repoDir, bareDir)
+	mustGit(t, "-C", bareDir, "update-ref", "refs/heads/master", first)
+	t.Chdir(bareDir)
+	catFile.Close()
+
+	var out bytes.Buffer
+	require.NoError(t, verifyReceive([]string{first, good, "refs/heads/master"}, nil, &out))
+	require.Empty(t, out.String())
+
+	zero := strings.Repeat("0", len(first))
+	stdin := strings.NewReader(first + " " + last + " refs/heads/master\n" + zero + " " + last + " refs/heads/new\n")
+	require.Error(t, verifyReceive(nil, stdin, &out))
+	for _, ref := range []string{"refs/heads/master", "refs/heads/new"} {
+		require.Contains(t, out.String(), ref+" ")
+		require.Contains(t, out.String(), "app/secret-3: not a strongbox encrypted resource\n")
+		require.Contains(t, out.String(), "other/secret: no .strongbox_recipient or .strongbox-keyid in the commit\n")
+		require.Contains(t, out.String(), "app/secret-4: invalid age")
+	}
+	require.NotContains(t, out.String(), "app/secret-2")
+	require.NotContains(t, out.String(), "app/public")
+
+	// deleting a branch
+	require.NoError(t, verifyReceive([]string{first, zero, "refs/heads/master"}, nil, &out))
+}